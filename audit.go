@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+
+	"github.com/betalotest/auth/server/access"
+	log "github.com/sirupsen/logrus"
+)
+
+func auditCmd(args []string) {
+	sub, args := subcommand("audit", args, "verify", "migrate")
+	fs, confPtr := newFlagSet("audit " + sub)
+	fs.Parse(args)
+
+	acc := mustAccess(*confPtr)
+
+	switch sub {
+	case "verify":
+		r, err := acc.VerifyAudit(context.Background())
+		if cerr, ok := err.(*access.AuditChainError); ok {
+			fmt.Printf("%d events verified before the first broken link\n", r.Events)
+			fmt.Fprintf(os.Stderr, "%s\n", cerr)
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatalf("failed to verify audit chain: %s", err)
+		}
+		fmt.Printf("audit chain ok: %d events, %d signed checkpoints\n", r.Events, r.Checkpoints)
+
+	case "migrate":
+		n, err := acc.MigrateAudit(context.Background())
+		if err != nil {
+			log.Fatalf("failed to chain audit events after %d: %s", n, err)
+		}
+		fmt.Printf("%d audit events chained\n", n)
+	}
+}
+
+// cliAudit records e in the audit trail as done by the operator
+// running the cli, failing to record it is only logged
+func cliAudit(acc *access.Access, e access.AuditEvent) {
+	e.Actor, e.UserAgent = cliActor(), "auth cli"
+	if err := acc.RecordAudit(context.Background(), e); err != nil {
+		log.Errorf("failed to audit %s of %s: %s", e.Action, e.Target, err)
+	}
+}
+
+// cliActor names the operator by the system login running the cli
+func cliActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
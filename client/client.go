@@ -0,0 +1,227 @@
+// Package client is the Go client of the auth service API.
+//
+//	c := client.New("https://auth.example.com")
+//	t, err := c.Token(ctx, "gopher@foomail.com", "foobar321")
+//
+// Transport keeps a token fresh for outgoing requests:
+//
+//	hc := &http.Client{Transport: client.NewTransport(c, t)}
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client calls the auth service at BaseURL
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// Token is an access token issued by the auth service
+type Token struct {
+	AccessToken string `json:"token"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+// Expiry returns when the token expires
+func (t Token) Expiry() time.Time {
+	return time.Unix(t.ExpiresAt, 0)
+}
+
+// Introspection is what the auth service knows about a token,
+// the claims are only set for active tokens
+type Introspection struct {
+	Active      bool     `json:"active"`
+	Subject     string   `json:"sub"`
+	User        string   `json:"user"`
+	Email       string   `json:"email"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	Issuer      string   `json:"iss"`
+	Audience    string   `json:"aud"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+
+	// Confirmation is set for tokens bound to a client certificate,
+	// they must only be accepted over connections using it
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+}
+
+// Confirmation holds the thumbprint of the client
+// certificate a token is bound to, RFC 8705
+type Confirmation struct {
+	X5tS256 string `json:"x5t#S256"`
+}
+
+// Error is an error response of the auth service
+type Error struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+	Cause       string `json:"cause"`
+}
+
+func (e *Error) Error() string {
+	if e.Cause == "" {
+		return fmt.Sprintf("auth: %d %s", e.Code, e.Description)
+	}
+	return fmt.Sprintf("auth: %d %s: %s", e.Code, e.Description, e.Cause)
+}
+
+// IsBadRequest - check if err is an auth service error for invalid input
+func IsBadRequest(err error) bool { return hasCode(err, http.StatusBadRequest) }
+
+// IsUnauthorized - check if err is an auth service error for a missing,
+// invalid or revoked token
+func IsUnauthorized(err error) bool { return hasCode(err, http.StatusUnauthorized) }
+
+// IsForbidden - check if err is an auth service error for a disabled or
+// locked account, a pending password reset or a missing permission
+func IsForbidden(err error) bool { return hasCode(err, http.StatusForbidden) }
+
+// IsNotFound - check if err is an auth service error for an unknown user
+func IsNotFound(err error) bool { return hasCode(err, http.StatusNotFound) }
+
+func hasCode(err error, code int) bool {
+	e, ok := errors.Cause(err).(*Error)
+	return ok && e.Code == code
+}
+
+// New returns a client for the auth service at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Signup - register a new user, returning its ID
+func (c *Client) Signup(ctx context.Context, name, email, password string) (string, error) {
+	return c.SignupWithInvite(ctx, "", name, email, password)
+}
+
+// SignupWithInvite - register a new user redeeming the invite
+// code, needed while signup is invite only. Returns the user ID
+func (c *Client) SignupWithInvite(ctx context.Context, invite, name, email, password string) (string, error) {
+	form := url.Values{
+		"username":       {name},
+		"email":          {email},
+		"password":       {password},
+		"password_check": {password},
+	}
+	if invite != "" {
+		form.Set("invite", invite)
+	}
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, "/signup", "", form, &resp); err != nil {
+		return "", errors.Wrap(err, "could not sign up")
+	}
+	return resp.ID, nil
+}
+
+// Token - issue a new token for the user
+func (c *Client) Token(ctx context.Context, email, password string) (*Token, error) {
+	form := url.Values{
+		"email":    {email},
+		"password": {password},
+	}
+
+	t := &Token{}
+	if err := c.do(ctx, "/token", "", form, t); err != nil {
+		return nil, errors.Wrap(err, "could not issue token")
+	}
+	return t, nil
+}
+
+// CertificateToken - issue a new token for the user named by the client
+// certificate of HTTPClient, bound to that certificate
+func (c *Client) CertificateToken(ctx context.Context) (*Token, error) {
+	t := &Token{}
+	if err := c.do(ctx, "/token/certificate", "", nil, t); err != nil {
+		return nil, errors.Wrap(err, "could not issue certificate token")
+	}
+	return t, nil
+}
+
+// Refresh - trade a valid token for a new one
+func (c *Client) Refresh(ctx context.Context, token string) (*Token, error) {
+	t := &Token{}
+	if err := c.do(ctx, "/token/refresh", token, nil, t); err != nil {
+		return nil, errors.Wrap(err, "could not refresh token")
+	}
+	return t, nil
+}
+
+// Revoke - revoke token, the other tokens of its owner stay valid.
+// Tokens issued before they had IDs take every token of the owner
+// with them, signing out everywhere is /me/signout-everywhere
+func (c *Client) Revoke(ctx context.Context, token string) error {
+	if err := c.do(ctx, "/token/revoke", token, nil, nil); err != nil {
+		return errors.Wrap(err, "could not revoke token")
+	}
+	return nil
+}
+
+// Introspect - ask the auth service whether token is active
+func (c *Client) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	i := &Introspection{}
+	if err := c.do(ctx, "/introspect", "", url.Values{"token": {token}}, i); err != nil {
+		return nil, errors.Wrap(err, "could not introspect token")
+	}
+	return i, nil
+}
+
+// do posts form to path with token as bearer, when not empty, decoding
+// the JSON response into v or returning the *Error the service answered
+func (c *Client) do(ctx context.Context, path, token string, form url.Values, v interface{}) error {
+	req, err := http.NewRequest("POST", c.BaseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "could not create request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not execute request")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "could not read response")
+	}
+
+	if resp.StatusCode >= 400 {
+		e := &Error{}
+		if err := json.Unmarshal(body, e); err != nil || e.Code == 0 {
+			e = &Error{Code: resp.StatusCode, Description: http.StatusText(resp.StatusCode)}
+		}
+		return e
+	}
+
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.Wrap(err, "could not decode response")
+	}
+	return nil
+}
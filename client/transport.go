@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultLeeway is how long before expiring tokens get refreshed
+const defaultLeeway = time.Minute
+
+// Transport is an http.RoundTripper adding a bearer token to every
+// request, refreshing it through Client before it expires
+type Transport struct {
+	// Client refreshes the token
+	Client *Client
+
+	// Base executes the requests, defaults to http.DefaultTransport
+	Base http.RoundTripper
+
+	// Leeway is how long before expiring the token gets refreshed,
+	// defaults to a minute
+	Leeway time.Duration
+
+	// Login, if set, is used to get a brand new token when the current
+	// one can't be refreshed anymore, e.g. after being revoked
+	Login func(ctx context.Context) (*Token, error)
+
+	mu    sync.Mutex
+	token *Token
+}
+
+// NewTransport returns a transport starting with token t
+func NewTransport(c *Client, t *Token) *Transport {
+	return &Transport{Client: c, token: t}
+}
+
+// Token returns the current token, refreshing it if needed
+func (t *Transport) Token(ctx context.Context) (*Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	leeway := t.Leeway
+	if leeway == 0 {
+		leeway = defaultLeeway
+	}
+
+	if t.token != nil && time.Now().Add(leeway).Before(t.token.Expiry()) {
+		return t.token, nil
+	}
+
+	var err error
+	if t.token != nil {
+		var fresh *Token
+		if fresh, err = t.Client.Refresh(ctx, t.token.AccessToken); err == nil {
+			t.token = fresh
+			return fresh, nil
+		}
+	}
+
+	if t.Login == nil {
+		if err == nil {
+			err = errors.New("no token to refresh")
+		}
+		return nil, errors.Wrap(err, "could not get a fresh token")
+	}
+
+	fresh, err := t.Login(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not log in")
+	}
+	t.token = fresh
+	return fresh, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	// round trippers must not modify the request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	r.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	refreshes := 0
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token/refresh" || r.Header.Get("Authorization") != "Bearer expiring" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(Error{401, "Unauthorized", "invalid token"})
+			return
+		}
+		refreshes++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(Token{"fresh", time.Now().Add(time.Hour).Unix()})
+	}))
+	defer auth.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer api.Close()
+
+	tt := []struct {
+		label     string
+		token     *Token
+		login     func(context.Context) (*Token, error)
+		auth      string
+		refreshes int
+	}{
+		{"valid", &Token{"valid", time.Now().Add(time.Hour).Unix()}, nil, "Bearer valid", 0},
+		{"expiring", &Token{"expiring", time.Now().Add(time.Second).Unix()}, nil, "Bearer fresh", 1},
+		{"revoked without login", &Token{"revoked", time.Now().Unix()}, nil, "", 0},
+		{"revoked with login", &Token{"revoked", time.Now().Unix()}, func(context.Context) (*Token, error) {
+			return &Token{"login", time.Now().Add(time.Hour).Unix()}, nil
+		}, "Bearer login", 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			refreshes = 0
+
+			tr := NewTransport(New(auth.URL), tc.token)
+			tr.Login = tc.login
+			hc := &http.Client{Transport: tr}
+
+			resp, err := hc.Get(api.URL)
+			if tc.auth == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("expected error for revoked token")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not execute request: %s", err)
+			}
+			defer resp.Body.Close()
+
+			var b [64]byte
+			n, _ := resp.Body.Read(b[:])
+			if string(b[:n]) != tc.auth {
+				t.Errorf("expected authorization '%s'; got '%s'", tc.auth, b[:n])
+			}
+
+			if refreshes != tc.refreshes {
+				t.Errorf("expected %d refreshes; got %d", tc.refreshes, refreshes)
+			}
+		})
+	}
+}
+
+func TestErrorPredicates(t *testing.T) {
+	err := error(&Error{Code: 403, Description: "Forbidden", Cause: "account locked"})
+
+	if !IsForbidden(err) || IsUnauthorized(err) || IsBadRequest(err) || IsNotFound(err) {
+		t.Errorf("expected only IsForbidden to match %s", err)
+	}
+
+	if err.Error() != "auth: 403 Forbidden: account locked" {
+		t.Errorf("expected error 'auth: 403 Forbidden: account locked'; got '%s'", err)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/betalotest/auth/server/access"
+	log "github.com/sirupsen/logrus"
+)
+
+func configCmd(args []string) {
+	sub, args := subcommand("config", args, "check")
+	fs, confPtr := newFlagSet("config " + sub)
+	fs.Parse(args)
+
+	if err := access.CheckConfig(*confPtr); err != nil {
+		log.Fatalf("invalid configuration: %s", err)
+	}
+	fmt.Printf("%s is ok\n", *confPtr)
+}
@@ -1,14 +1,116 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
 
 	"github.com/betalotest/auth/server"
+	"github.com/betalotest/auth/server/access"
+	log "github.com/sirupsen/logrus"
 )
 
+const defaultConf = "resources/server/prod/conf.yml"
+
+const usage = `usage: auth <command> [<args>]
+
+commands:
+  serve                  start the auth server
+  user create            register a new user
+  user disable           disable (or -enable) a user
+  user reset-password    require a user to change password
+  user roles             assign roles to a user
+  user list              search and list users
+  token issue            issue a new token for a user
+  token verify           verify a token and print its claims
+  token revoke           revoke every token of a user
+  audit verify           check the audit log hash chain
+  audit migrate          chain the audit events recorded before the chain
+  config check           check the configuration file and db conn
+
+run 'auth <command> -h' for the command flags
+`
+
 func main() {
-	confPtr := flag.String("conf", "resources/server/prod/conf.yml", "configuration file")
-	flag.Parse()
+	// a bare 'auth -conf ...' keeps serving as it always did
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		serve(os.Args[1:])
+		return
+	}
+
+	cmd, args := os.Args[1], os.Args[2:]
+
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "user":
+		userCmd(args)
+	case "token":
+		tokenCmd(args)
+	case "audit":
+		auditCmd(args)
+	case "config":
+		configCmd(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+func serve(args []string) {
+	fs, confPtr := newFlagSet("serve")
+	fs.Parse(args)
+
+	if err := server.Serve(*confPtr); err != nil {
+		log.Fatalf("failed to serve: %s", err)
+	}
+}
+
+// newFlagSet returns a flag set for the command name
+// with the -conf flag shared by every command
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return fs, fs.String("conf", defaultConf, "configuration file")
+}
+
+// subcommand splits args into the subcommand name and its args,
+// exiting with the command usage if there is none
+func subcommand(cmd string, args []string, subs ...string) (string, []string) {
+	if len(args) > 0 {
+		for _, s := range subs {
+			if args[0] == s {
+				return s, args[1:]
+			}
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "usage: auth %s <%s> [<args>]\n", cmd, strings.Join(subs, "|"))
+	os.Exit(2)
+	return "", nil
+}
+
+// mustAccess grants access or exits
+func mustAccess(configfile string) *access.Access {
+	acc, err := access.New(configfile)
+	if err != nil {
+		log.Fatalf("failed to get access: %s", err)
+	}
+	return acc
+}
+
+// mustFindUser finds the user registered with email or exits
+func mustFindUser(acc *access.Access, email string) access.User {
+	if email == "" {
+		log.Fatal("missing -email")
+	}
 
-	server.Serve(*confPtr)
+	u, err := acc.FindUserByEmail(context.Background(), email)
+	if err != nil {
+		log.Fatalf("failed to find user: %s", err)
+	}
+	return u
 }
@@ -1,12 +1,19 @@
 package access
 
 import (
+	"context"
 	"fmt"
 	"time"
 
+	"github.com/betalotest/auth/server/logging"
+	"github.com/betalotest/auth/server/metrics"
+	"github.com/betalotest/auth/server/tracing"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -17,15 +24,36 @@ type config struct {
 	dbName    string
 	userc     string
 	tokenc    string
+	auditc    string
+	checkc    string
+	sessionc  string
+	patc      string
+	magicc    string
+	invitec   string
+	webhookc  string
 	signature string
 	issuer    string
+	audience  string
+
+	sessionIdle   time.Duration
+	sessionMaxAge time.Duration
+	magicLinkTTL  time.Duration
+
+	webhooks []Subscription
 }
 
 // conn wraps mgo session and collections
 type conn struct {
 	*mgo.Session
-	userc  *mgo.Collection
-	tokenc *mgo.Collection
+	userc    *mgo.Collection
+	tokenc   *mgo.Collection
+	auditc   *mgo.Collection
+	checkc   *mgo.Collection
+	sessionc *mgo.Collection
+	patc     *mgo.Collection
+	magicc   *mgo.Collection
+	invitec  *mgo.Collection
+	webhookc *mgo.Collection
 }
 
 // Access grant access to db and jwt
@@ -33,14 +61,39 @@ type Access struct {
 	*conn
 	Signature string
 	Issuer    string
+	Audience  string
+
+	// SessionIdle and SessionMaxAge are the idle and
+	// absolute timeouts of browser sessions
+	SessionIdle   time.Duration
+	SessionMaxAge time.Duration
+
+	// MagicLinkTTL is how long a login link stays usable
+	MagicLinkTTL time.Duration
+
+	// Webhooks are the subscriptions to user lifecycle events
+	Webhooks []Subscription
 }
 
 // User wraps data related to an auth user
 type User struct {
-	Name         string `json:"name"`
-	Email        string `json:"email"`
-	PasswordHash string `json:"passwordhash"`
-	CreatedAt    string `json:"createdat"`
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Email        string   `json:"email"`
+	PasswordHash string   `json:"-"`
+	CreatedAt    string   `json:"createdat"`
+	Roles        []string `json:"roles"`
+	Permissions  []string `json:"permissions"`
+
+	// account state managed by admins and failed logins
+	Disabled              bool  `json:"disabled"`
+	PasswordResetRequired bool  `json:"passwordresetrequired"`
+	FailedLogins          int   `json:"failedlogins"`
+	LockedUntil           int64 `json:"lockeduntil"`
+	TokensRevokedAt       int64 `json:"tokensrevokedat"`
+
+	// EmailVerifiedAt is when the user first proved owning the email
+	EmailVerifiedAt int64 `json:"emailverifiedat,omitempty"`
 }
 
 // Credential wraps data related to user access to api
@@ -49,13 +102,28 @@ type Credential struct {
 	CreatedAt string `json:"created_at"`
 }
 
-// Claim wraps the info we want to pass in the JWT
+// Claim wraps the info we want to pass in the JWT,
+// the user ID goes as the standard 'sub' claim.
+// Confirmation is set for tokens bound to a client certificate
 type Claim struct {
-	User  string `json:"user"`
-	Email string `json:"email"`
+	User         string        `json:"user"`
+	Email        string        `json:"email"`
+	Roles        []string      `json:"roles,omitempty"`
+	Permissions  []string      `json:"permissions,omitempty"`
+	Confirmation *Confirmation `json:"cnf,omitempty"`
 	jwt.StandardClaims
 }
 
+// DialError is returned by New when the db can't be reached,
+// unlike its other errors it may go away trying again
+type DialError struct {
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return "could not create db conn: " + e.Err.Error()
+}
+
 // New - given a path to a configuration
 // file grants Access to the caller
 func New(configpath string) (*Access, error) {
@@ -66,77 +134,362 @@ func New(configpath string) (*Access, error) {
 
 	sess, err := mgo.Dial(conf.dbAddress)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not create db conn")
+		return nil, &DialError{err}
 	}
 
 	userc := sess.DB(conf.dbName).C(conf.userc)
 	tokenc := sess.DB(conf.dbName).C(conf.tokenc)
+	auditc := sess.DB(conf.dbName).C(conf.auditc)
+	checkc := sess.DB(conf.dbName).C(conf.checkc)
+	sessionc := sess.DB(conf.dbName).C(conf.sessionc)
+	patc := sess.DB(conf.dbName).C(conf.patc)
+	magicc := sess.DB(conf.dbName).C(conf.magicc)
+	invitec := sess.DB(conf.dbName).C(conf.invitec)
+	webhookc := sess.DB(conf.dbName).C(conf.webhookc)
+
+	conn := &conn{sess, userc, tokenc, auditc, checkc, sessionc, patc, magicc, invitec, webhookc}
+	a := &Access{conn, conf.signature, conf.issuer, conf.audience, conf.sessionIdle, conf.sessionMaxAge, conf.magicLinkTTL, conf.webhooks}
+
+	// users created before IDs existed must get one
+	// before the unique index on it can be built
+	if _, err := a.MigrateUserIDs(context.Background()); err != nil {
+		sess.Close()
+		return nil, errors.Wrap(err, "could not migrate user ids")
+	}
 
-	conn := &conn{sess, userc, tokenc}
-	return &Access{conn, conf.signature, conf.issuer}, nil
+	if err := a.ensureIndexes(); err != nil {
+		sess.Close()
+		return nil, errors.Wrap(err, "could not ensure db indexes")
+	}
+	return a, nil
 }
 
-// FindUserByEmail - use email to retrieve user's details from DB and return a user struct
-func (a Access) FindUserByEmail(email string) (User, error) {
+// Ping - check the db answers, on a fresh socket so a
+// broken connection doesn't hide it came back
+func (a Access) Ping(ctx context.Context) error {
+	if a.conn == nil {
+		return errors.New("no db connection")
+	}
+
+	defer observeStorage(ctx, "ping")()
+
+	sess := a.Session.Copy()
+	defer sess.Close()
+	if err := sess.Ping(); err != nil {
+		return errors.Wrap(err, "could not ping db")
+	}
+	return nil
+}
+
+// observeStorage - time and trace the storage operation op until the returned
+// func is called, logging it at debug level with the request logger of ctx
+func observeStorage(ctx context.Context, op string) func() {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "storage."+op, semconv.DBSystemMongoDB, semconv.DBOperationName(op))
+	return func() {
+		span.End()
+		d := time.Since(start)
+		metrics.StorageDuration.WithLabelValues(op).Observe(d.Seconds())
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"op":         op,
+			"latency_ms": float64(d) / float64(time.Millisecond),
+		}).Debug("storage call")
+	}
+}
+
+// FindUserByID - use the user ID to retrieve user's details from DB and return a user struct
+func (a Access) FindUserByID(ctx context.Context, id string) (User, error) {
+	defer observeStorage(ctx, "find_user_by_id")()
+
 	u := User{}
-	if err := a.userc.Find(bson.M{"email": email}).One(&u); err != nil {
-		return User{}, errors.Wrap(err, "could not retrieve details for user "+email)
+	if err := a.userc.Find(bson.M{"id": id}).One(&u); err != nil {
+		return User{}, errors.Wrap(err, "could not retrieve details for user "+id)
 	}
 	return u, nil
 }
 
-// UpdateToken - update the token document related to an user giving it a new token
-func (a Access) UpdateToken(email, token string) error {
-	// the index of the documment we want to modify
-	doc := bson.M{"email": email}
-
-	// the change we want to add
-	change := bson.M{"$set": bson.M{"token": token, "createdAt": time.Now().String()}}
+// FindUserByEmail - use email to retrieve user's details from DB and return a user struct
+func (a Access) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	defer observeStorage(ctx, "find_user_by_email")()
 
-	// db time!
-	if _, err := a.tokenc.Upsert(doc, change); err != nil {
-		return errors.Wrap(err, "could not update token for user "+email)
+	u := User{}
+	if err := a.userc.Find(bson.M{"email": email}).One(&u); err != nil {
+		return User{}, errors.Wrap(err, "could not retrieve details for user "+email)
 	}
-	return nil
+	return u, nil
 }
 
-// RegisterUser - add user to DB
-func (a Access) RegisterUser(name, email, passwordHash string) error {
+// RegisterUser - add user to DB with a newly generated ID and the default role
+func (a Access) RegisterUser(ctx context.Context, name, email, passwordHash string) (User, error) {
+	defer observeStorage(ctx, "register_user")()
+
 	u := User{
-		name,
-		email,
-		passwordHash,
-		time.Now().String(),
+		ID:           newID(),
+		Name:         name,
+		Email:        email,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Now().String(),
+		Roles:        []string{RoleUser},
 	}
 
 	if err := a.userc.Insert(u); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("could not insert user %s in db", email))
+		return User{}, errors.Wrap(err, fmt.Sprintf("could not insert user %s in db", email))
 	}
-	return nil
+	return u, nil
 }
 
-// NewToken - returns a new JWT
-func (a Access) NewToken(name, email string) (string, int64, error) {
-	expirationDate := time.Now().Add(time.Hour * 24).Unix()
+// NewToken - returns a new JWT with the given ID carrying the user roles
+// and permissions. Use IssueToken for tokens handed out to users
+func (a Access) NewToken(u User, id string) (string, int64, error) {
+	return a.newToken(u, id, "")
+}
+
+// newToken - NewToken bound to the client certificate
+// with the given thumbprint, unless it is empty
+func (a Access) newToken(u User, id, thumbprint string) (string, int64, error) {
+	var cnf *Confirmation
+	if thumbprint != "" {
+		cnf = &Confirmation{thumbprint}
+	}
+
+	now := time.Now()
+	expirationDate := now.Add(time.Hour * 24).Unix()
 	c := Claim{
-		name,
-		email,
+		u.Name,
+		u.Email,
+		u.EffectiveRoles(),
+		u.EffectivePermissions(),
+		cnf,
 		jwt.StandardClaims{
 			ExpiresAt: expirationDate,
+			IssuedAt:  now.Unix(),
 			Issuer:    a.Issuer,
+			Audience:  a.Audience,
+			Subject:   u.ID,
+			Id:        id,
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
 	ss, err := token.SignedString([]byte(a.Signature))
 	if err != nil {
-		return "", 0, errors.Wrap(err, "could not create token for user "+email)
+		return "", 0, errors.Wrap(err, "could not create token for user "+u.Email)
 	}
 	return ss, expirationDate, nil
 }
 
+// ParseToken - verify signature, expiration and issuer of a JWT
+// issued by NewToken and return its claims
+func (a Access) ParseToken(ss string) (*Claim, error) {
+	c := &Claim{}
+	_, err := jwt.ParseWithClaims(ss, c, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+		}
+		return []byte(a.Signature), nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse token")
+	}
+
+	if !c.VerifyIssuer(a.Issuer, true) {
+		return nil, fmt.Errorf("unexpected token issuer '%s'", c.Issuer)
+	}
+
+	if a.Audience != "" && !c.VerifyAudience(a.Audience, true) {
+		return nil, fmt.Errorf("unexpected token audience '%s'", c.Audience)
+	}
+	return c, nil
+}
+
+// MigrateUserIDs - backfill an ID for every user stored without one
+// and rekey their token documents on it, returning how many users
+// were migrated. Running it again on a migrated DB is a no-op
+func (a Access) MigrateUserIDs(ctx context.Context) (int, error) {
+	defer observeStorage(ctx, "migrate_user_ids")()
+
+	var users []struct {
+		OID   bson.ObjectId `bson:"_id"`
+		Email string        `bson:"email"`
+	}
+
+	if err := a.userc.Find(bson.M{"id": bson.M{"$exists": false}}).All(&users); err != nil {
+		return 0, errors.Wrap(err, "could not retrieve users without id")
+	}
+
+	for _, u := range users {
+		id := newID()
+
+		if err := a.userc.UpdateId(u.OID, bson.M{"$set": bson.M{"id": id}}); err != nil {
+			return 0, errors.Wrap(err, "could not set id for user "+u.Email)
+		}
+
+		// tokens used to be keyed on the user email
+		sel := bson.M{"email": u.Email, "userid": bson.M{"$exists": false}}
+		change := bson.M{"$set": bson.M{"userid": id}, "$unset": bson.M{"email": ""}}
+		if _, err := a.tokenc.UpdateAll(sel, change); err != nil {
+			return 0, errors.Wrap(err, "could not migrate token for user "+u.Email)
+		}
+	}
+	return len(users), nil
+}
+
+// ensureIndexes - make sure lookups by user ID are indexed
+func (a Access) ensureIndexes() error {
+	if err := a.userc.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure user id index")
+	}
+
+	if err := a.userc.EnsureIndex(mgo.Index{Key: []string{"email"}}); err != nil {
+		return errors.Wrap(err, "could not ensure user email index")
+	}
+
+	if err := a.migrateTokens(); err != nil {
+		return errors.Wrap(err, "could not migrate tokens")
+	}
+
+	if err := a.tokenc.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure token id index")
+	}
+
+	if err := a.tokenc.EnsureIndex(mgo.Index{Key: []string{"userid"}}); err != nil {
+		return errors.Wrap(err, "could not ensure token user id index")
+	}
+
+	if err := a.auditc.EnsureIndex(mgo.Index{Key: []string{"target", "-createdat"}}); err != nil {
+		return errors.Wrap(err, "could not ensure audit target index")
+	}
+
+	if err := a.auditc.EnsureIndex(mgo.Index{Key: []string{"actor", "-createdat"}}); err != nil {
+		return errors.Wrap(err, "could not ensure audit actor index")
+	}
+
+	if err := a.auditc.EnsureIndex(mgo.Index{Key: []string{"createdat"}}); err != nil {
+		return errors.Wrap(err, "could not ensure audit time index")
+	}
+
+	// sparse until MigrateAudit chains the events recorded before the chain
+	if err := a.auditc.EnsureIndex(mgo.Index{Key: []string{"seq"}, Unique: true, Sparse: true}); err != nil {
+		return errors.Wrap(err, "could not ensure audit seq index")
+	}
+
+	if err := a.checkc.EnsureIndex(mgo.Index{Key: []string{"seq"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure audit checkpoint seq index")
+	}
+
+	if err := a.sessionc.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure session hash index")
+	}
+
+	// sessions started before they had IDs have none
+	if err := a.sessionc.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true, Sparse: true}); err != nil {
+		return errors.Wrap(err, "could not ensure session id index")
+	}
+
+	if err := a.sessionc.EnsureIndex(mgo.Index{Key: []string{"userid"}}); err != nil {
+		return errors.Wrap(err, "could not ensure session user id index")
+	}
+
+	if err := a.patc.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure personal token hash index")
+	}
+
+	if err := a.patc.EnsureIndex(mgo.Index{Key: []string{"userid", "-createdat"}}); err != nil {
+		return errors.Wrap(err, "could not ensure personal token user id index")
+	}
+
+	if err := a.magicc.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure magic link hash index")
+	}
+
+	if err := a.invitec.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure invite hash index")
+	}
+
+	if err := a.invitec.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure invite id index")
+	}
+
+	if err := a.webhookc.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		return errors.Wrap(err, "could not ensure webhook delivery id index")
+	}
+
+	if err := a.webhookc.EnsureIndex(mgo.Index{Key: []string{"status", "nextattemptat"}}); err != nil {
+		return errors.Wrap(err, "could not ensure webhook delivery queue index")
+	}
+	return nil
+}
+
+// namespaceNotFound is the mongodb error code for missing collections
+const namespaceNotFound = 26
+
+// migrateTokens - tokens used to be a single document per user, unique
+// on the user ID. Their documents can go, the tokens stay valid until
+// they expire
+func (a Access) migrateTokens() error {
+	indexes, err := a.tokenc.Indexes()
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == namespaceNotFound {
+		// fresh db, nothing to migrate
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not list token indexes")
+	}
+
+	for _, idx := range indexes {
+		if !idx.Unique || len(idx.Key) != 1 || idx.Key[0] != "userid" {
+			continue
+		}
+
+		if err := a.tokenc.DropIndexName(idx.Name); err != nil {
+			return errors.Wrap(err, "could not drop unique token user id index")
+		}
+
+		if _, err := a.tokenc.RemoveAll(bson.M{"id": bson.M{"$exists": false}}); err != nil {
+			return errors.Wrap(err, "could not remove legacy tokens")
+		}
+	}
+	return nil
+}
+
+// newID - generates a new immutable user ID
+func newID() string {
+	return uuid.New().String()
+}
+
+// CheckConfig - make sure the configuration file has every
+// required value and that the db it points to is reachable
+func CheckConfig(configpath string) error {
+	conf, err := loadConfig(configpath)
+	if err != nil {
+		return errors.Wrap(err, "could not load configuration file")
+	}
+
+	sess, err := mgo.DialWithTimeout(conf.dbAddress, 5*time.Second)
+	if err != nil {
+		return errors.Wrap(err, "could not create db conn")
+	}
+	defer sess.Close()
+
+	if err := sess.Ping(); err != nil {
+		return errors.Wrap(err, "could not ping db")
+	}
+	return nil
+}
+
 func loadConfig(filepath string) (*config, error) {
 	viper.SetConfigFile(filepath)
+	viper.SetDefault("db_audit_collection", "audit")
+	viper.SetDefault("db_audit_checkpoint_collection", "auditcheckpoint")
+	viper.SetDefault("db_session_collection", "session")
+	viper.SetDefault("db_pat_collection", "pat")
+	viper.SetDefault("db_magiclink_collection", "magiclink")
+	viper.SetDefault("db_invite_collection", "invite")
+	viper.SetDefault("db_webhook_collection", "webhook")
+	viper.SetDefault("token_audience", "")
+	viper.SetDefault("session_idle_timeout", defaultSessionIdle)
+	viper.SetDefault("session_max_age", defaultSessionMaxAge)
+	viper.SetDefault("magic_link_ttl", defaultMagicLinkTTL)
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, errors.Wrap(err, "could not read from config file "+filepath)
 	}
@@ -156,12 +509,33 @@ func loadConfig(filepath string) (*config, error) {
 		}
 	}
 
+	var webhooks []Subscription
+	if err := viper.UnmarshalKey("webhooks", &webhooks); err != nil {
+		return nil, errors.Wrap(err, "could not read webhooks from config file")
+	}
+
+	if err := validateSubscriptions(webhooks); err != nil {
+		return nil, errors.Wrap(err, "invalid webhooks")
+	}
+
 	return &config{
 		viper.GetString("db_address"),
 		viper.GetString("db_name"),
 		viper.GetString("db_user_collection"),
 		viper.GetString("db_token_collection"),
+		viper.GetString("db_audit_collection"),
+		viper.GetString("db_audit_checkpoint_collection"),
+		viper.GetString("db_session_collection"),
+		viper.GetString("db_pat_collection"),
+		viper.GetString("db_magiclink_collection"),
+		viper.GetString("db_invite_collection"),
+		viper.GetString("db_webhook_collection"),
 		viper.GetString("token_signature"),
 		viper.GetString("token_issuer"),
+		viper.GetString("token_audience"),
+		viper.GetDuration("session_idle_timeout"),
+		viper.GetDuration("session_max_age"),
+		viper.GetDuration("magic_link_ttl"),
+		webhooks,
 	}, nil
 }
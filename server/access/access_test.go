@@ -0,0 +1,467 @@
+package access
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNewToken(t *testing.T) {
+	a := Access{Signature: "foobar", Issuer: "tester"}
+
+	u := User{
+		ID:    "4f1c6b1e-2c3d-4e5f-8a9b-0c1d2e3f4a5b",
+		Name:  "gopher",
+		Email: "gopher@foomail.com",
+		Roles: []string{RoleAdmin},
+	}
+
+	ss, exp, err := a.NewToken(u, "9b2e7c4a")
+	if err != nil {
+		t.Fatalf("could not create token: %s", err)
+	}
+
+	c, err := a.ParseToken(ss)
+	if err != nil {
+		t.Fatalf("could not parse token: %s", err)
+	}
+
+	if c.Subject != "4f1c6b1e-2c3d-4e5f-8a9b-0c1d2e3f4a5b" {
+		t.Errorf("expected sub '4f1c6b1e-2c3d-4e5f-8a9b-0c1d2e3f4a5b'; got '%s'", c.Subject)
+	}
+
+	if c.Email != "gopher@foomail.com" {
+		t.Errorf("expected email 'gopher@foomail.com'; got '%s'", c.Email)
+	}
+
+	if c.ExpiresAt != exp {
+		t.Errorf("expected exp %d; got %d", exp, c.ExpiresAt)
+	}
+
+	if c.Id != "9b2e7c4a" {
+		t.Errorf("expected jti '9b2e7c4a'; got '%s'", c.Id)
+	}
+
+	if !c.HasPermission(PermRolesWrite) {
+		t.Errorf("expected admin token to grant %s; got %v", PermRolesWrite, c.Permissions)
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	a := Access{Signature: "foobar", Issuer: "tester"}
+
+	sign := func(c jwt.Claims, m jwt.SigningMethod, key interface{}) string {
+		ss, err := jwt.NewWithClaims(m, c).SignedString(key)
+		if err != nil {
+			t.Fatalf("could not sign token: %s", err)
+		}
+		return ss
+	}
+
+	tt := []struct {
+		label string
+		token string
+		valid bool
+	}{
+		{"valid", sign(Claim{StandardClaims: jwt.StandardClaims{Issuer: "tester"}}, jwt.SigningMethodHS256, []byte("foobar")), true},
+		{"wrong signature", sign(Claim{StandardClaims: jwt.StandardClaims{Issuer: "tester"}}, jwt.SigningMethodHS256, []byte("xablau")), false},
+		{"wrong issuer", sign(Claim{StandardClaims: jwt.StandardClaims{Issuer: "xablau"}}, jwt.SigningMethodHS256, []byte("foobar")), false},
+		{"expired", sign(Claim{StandardClaims: jwt.StandardClaims{Issuer: "tester", ExpiresAt: 1}}, jwt.SigningMethodHS256, []byte("foobar")), false},
+		{"unsigned", sign(Claim{StandardClaims: jwt.StandardClaims{Issuer: "tester"}}, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType), false},
+		{"garbage", "xablau", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if _, err := a.ParseToken(tc.token); (err == nil) != tc.valid {
+				t.Errorf("expected valid to be %t; got error '%v'", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestEffectivePermissions(t *testing.T) {
+	tt := []struct {
+		label string
+		user  User
+		perms []string
+	}{
+		{"no roles", User{}, []string{}},
+		{"plain user", User{Roles: []string{RoleUser}}, []string{}},
+		{"direct grant", User{Roles: []string{RoleUser}, Permissions: []string{PermUsersRead}}, []string{PermUsersRead}},
+		{"admin", User{Roles: []string{RoleAdmin}, Permissions: []string{PermUsersRead}}, []string{PermAuditRead, PermRolesWrite, PermUsersRead, PermUsersWrite}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			perms := tc.user.EffectivePermissions()
+			if strings.Join(perms, ",") != strings.Join(tc.perms, ",") {
+				t.Errorf("expected permissions %v; got %v", tc.perms, perms)
+			}
+		})
+	}
+}
+
+func TestScopedPermissions(t *testing.T) {
+	tt := []struct {
+		label  string
+		user   User
+		scopes []string
+		perms  []string
+	}{
+		{"no scopes", User{Roles: []string{RoleAdmin}}, nil, []string{}},
+		{"granted scope", User{Roles: []string{RoleAdmin}}, []string{PermUsersRead}, []string{PermUsersRead}},
+		{"ungranted scope", User{Roles: []string{RoleUser}}, []string{PermUsersRead}, []string{}},
+		{"direct grant", User{Permissions: []string{PermUsersRead}}, []string{PermUsersRead, PermUsersWrite}, []string{PermUsersRead}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			perms := tc.user.ScopedPermissions(tc.scopes)
+			if strings.Join(perms, ",") != strings.Join(tc.perms, ",") {
+				t.Errorf("expected permissions %v; got %v", tc.perms, perms)
+			}
+		})
+	}
+}
+
+func TestClaimRestrictTo(t *testing.T) {
+	// what an admin token carries
+	admin := func() *Claim {
+		return &Claim{Roles: []string{RoleAdmin}, Permissions: []string{PermAuditRead, PermRolesWrite, PermUsersRead, PermUsersWrite}}
+	}
+
+	tt := []struct {
+		label string
+		user  User
+		roles []string
+		perms []string
+	}{
+		{"still admin", User{Roles: []string{RoleAdmin}}, []string{RoleAdmin}, []string{PermAuditRead, PermRolesWrite, PermUsersRead, PermUsersWrite}},
+		{"demoted", User{Roles: []string{RoleUser}}, []string{}, []string{}},
+		{"demoted with grant", User{Roles: []string{RoleUser}, Permissions: []string{PermUsersRead}}, []string{}, []string{PermUsersRead}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			c := admin()
+			c.restrictTo(tc.user)
+
+			if strings.Join(c.Roles, ",") != strings.Join(tc.roles, ",") {
+				t.Errorf("expected roles %v; got %v", tc.roles, c.Roles)
+			}
+			if strings.Join(c.Permissions, ",") != strings.Join(tc.perms, ",") {
+				t.Errorf("expected permissions %v; got %v", tc.perms, c.Permissions)
+			}
+		})
+	}
+}
+
+func TestValidateRoles(t *testing.T) {
+	if err := ValidateRoles([]string{RoleAdmin, RoleUser}); err != nil {
+		t.Errorf("expected known roles to be valid; got '%s'", err)
+	}
+
+	if err := ValidateRoles([]string{"xablau"}); err == nil || err.Error() != "unknown role 'xablau'" {
+		t.Errorf("expected error 'unknown role 'xablau''; got '%v'", err)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	a, b := newID(), newID()
+	if a == "" || a == b {
+		t.Errorf("expected unique non empty ids; got '%s' and '%s'", a, b)
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	now := time.Now()
+
+	tt := []struct {
+		label    string
+		created  time.Duration
+		lastUsed time.Duration
+		expired  bool
+	}{
+		{"fresh", 0, 0, false},
+		{"recently used", 2 * time.Hour, time.Minute, false},
+		{"idle", time.Hour, 31 * time.Minute, true},
+		{"too old", 25 * time.Hour, time.Minute, true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			s := Session{
+				CreatedAt:  now.Add(-tc.created).Unix(),
+				LastUsedAt: now.Add(-tc.lastUsed).Unix(),
+			}
+
+			if expired := s.Expired(now, 30*time.Minute, 24*time.Hour); expired != tc.expired {
+				t.Errorf("expected expired %t; got %t", tc.expired, expired)
+			}
+		})
+	}
+}
+
+func TestActiveUser(t *testing.T) {
+	tt := []struct {
+		label   string
+		user    User
+		allowed bool
+	}{
+		{"active", User{ID: "1"}, true},
+		{"disabled", User{ID: "1", Disabled: true}, false},
+		{"password reset required", User{ID: "1", PasswordResetRequired: true}, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if err := activeUser(tc.user); (err == nil) != tc.allowed {
+				t.Errorf("expected allowed %t; got %v", tc.allowed, err)
+			}
+		})
+	}
+}
+
+func TestPersonalTokenExpired(t *testing.T) {
+	now := time.Now()
+
+	tt := []struct {
+		label     string
+		expiresAt int64
+		expired   bool
+	}{
+		{"never expires", 0, false},
+		{"future", now.Add(time.Hour).Unix(), false},
+		{"past", now.Add(-time.Hour).Unix(), true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if expired := (PersonalToken{ExpiresAt: tc.expiresAt}).Expired(now); expired != tc.expired {
+				t.Errorf("expected expired %t; got %t", tc.expired, expired)
+			}
+		})
+	}
+}
+
+func TestValidMagicLink(t *testing.T) {
+	a := Access{Signature: "foobar", Issuer: "tester"}
+	nonce := "c2VjcmV0"
+	signed := nonce + "." + a.signMagicLink(nonce)
+
+	tt := []struct {
+		label  string
+		secret string
+		valid  bool
+	}{
+		{"signed", signed, true},
+		{"empty", "", false},
+		{"unsigned", nonce, false},
+		{"tampered nonce", "x" + signed, false},
+		{"other signature", nonce + "." + Access{Signature: "xablau"}.signMagicLink(nonce), false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if valid := a.validMagicLink(tc.secret); valid != tc.valid {
+				t.Errorf("expected valid %t; got %t", tc.valid, valid)
+			}
+		})
+	}
+}
+
+func TestMagicLinkTooSoon(t *testing.T) {
+	now := time.Now()
+
+	tt := []struct {
+		label   string
+		created time.Duration
+		tooSoon bool
+	}{
+		{"just sent", 0, true},
+		{"within interval", 30 * time.Second, true},
+		{"past interval", 2 * time.Minute, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			l := MagicLink{CreatedAt: now.Add(-tc.created).Unix()}
+			if tooSoon := l.tooSoon(now); tooSoon != tc.tooSoon {
+				t.Errorf("expected too soon %t; got %t", tc.tooSoon, tooSoon)
+			}
+		})
+	}
+}
+
+func TestAuditFilterQuery(t *testing.T) {
+	tt := []struct {
+		label  string
+		filter AuditFilter
+		query  bson.M
+	}{
+		{"everything", AuditFilter{}, bson.M{}},
+		{"action and actor", AuditFilter{Action: AuditLoginFailure, Actor: "4f1c6b1e"}, bson.M{"action": AuditLoginFailure, "actor": "4f1c6b1e"}},
+		{"target since", AuditFilter{Target: "9b2e7c4a", Since: 100}, bson.M{"target": "9b2e7c4a", "createdat": bson.M{"$gte": int64(100)}}},
+		{"time range", AuditFilter{Since: 100, Until: 200}, bson.M{"createdat": bson.M{"$gte": int64(100), "$lt": int64(200)}}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if q := tc.filter.query(); !reflect.DeepEqual(q, tc.query) {
+				t.Errorf("expected query %v; got %v", tc.query, q)
+			}
+		})
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	a := Access{Signature: "foobar", Issuer: "tester"}
+
+	// a chain of 250 events with checkpoints at 100 and 200
+	chain := func() ([]AuditEvent, []AuditCheckpoint) {
+		var events []AuditEvent
+		var checkpoints []AuditCheckpoint
+		tip := AuditEvent{}
+		for i := 1; i <= 250; i++ {
+			tip = tip.link(AuditEvent{Action: AuditLoginSuccess, Actor: "4f1c6b1e", CreatedAt: int64(i)})
+			events = append(events, tip)
+			if tip.Seq%auditCheckpointEvery == 0 {
+				c := AuditCheckpoint{Seq: tip.Seq, Hash: tip.Hash, CreatedAt: int64(i)}
+				c.Signature = a.signCheckpoint(c)
+				checkpoints = append(checkpoints, c)
+			}
+		}
+		return events, checkpoints
+	}
+
+	tt := []struct {
+		label  string
+		tamper func([]AuditEvent, []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint)
+		seq    int64
+		reason string
+	}{
+		{"intact", func(e []AuditEvent, c []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint) {
+			return e, c
+		}, 0, ""},
+		{"edited event", func(e []AuditEvent, c []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint) {
+			e[149].Actor = "9b2e7c4a"
+			return e, c
+		}, 150, "hash does not match the event"},
+		{"removed event", func(e []AuditEvent, c []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint) {
+			return append(e[:119:119], e[120:]...), c
+		}, 120, "expected seq 120; found 121"},
+		{"rehashed chain", func(e []AuditEvent, c []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint) {
+			e[149].Actor = "9b2e7c4a"
+			for i := 149; i < len(e); i++ {
+				e[i] = e[i-1].link(e[i])
+			}
+			return e, c
+		}, 200, "checkpoint hash does not match"},
+		{"forged checkpoint", func(e []AuditEvent, c []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint) {
+			c[0].CreatedAt++
+			return e, c
+		}, 100, "checkpoint signature does not match"},
+		{"truncated chain", func(e []AuditEvent, c []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint) {
+			return e[:180], c
+		}, 181, "events missing, checkpoint at seq 200"},
+		{"removed checkpoint", func(e []AuditEvent, c []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint) {
+			return e, c[:1]
+		}, 200, "checkpoint missing"},
+		{"unchained event", func(e []AuditEvent, c []AuditCheckpoint) ([]AuditEvent, []AuditCheckpoint) {
+			// events out of the chain sort first by seq
+			return append([]AuditEvent{{Action: AuditLoginSuccess, Actor: "9b2e7c4a"}}, e...), c
+		}, 1, "event out of the chain"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			events, checkpoints := tc.tamper(chain())
+
+			w := a.newChainWalker(checkpoints)
+			var err error
+			for _, e := range events {
+				if err = w.next(e); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = w.finish()
+			}
+
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatalf("expected intact chain; got %s", err)
+				}
+				if r := w.report(); r.Events != 250 || r.Checkpoints != 2 {
+					t.Errorf("expected 250 events and 2 checkpoints; got %+v", r)
+				}
+				return
+			}
+
+			cerr, ok := err.(*AuditChainError)
+			if !ok {
+				t.Fatalf("expected chain error; got %v", err)
+			}
+			if cerr.Seq != tc.seq || cerr.Reason != tc.reason {
+				t.Errorf("expected break at %d '%s'; got %d '%s'", tc.seq, tc.reason, cerr.Seq, cerr.Reason)
+			}
+		})
+	}
+}
+
+func TestValidateSubscriptions(t *testing.T) {
+	crm := Subscription{"crm", "https://crm.example.com/hooks", "secret", []string{WebhookUserCreated}}
+
+	tt := []struct {
+		label string
+		subs  []Subscription
+		err   string
+	}{
+		{"valid", []Subscription{crm}, ""},
+		{"missing secret", []Subscription{{"crm", "https://crm.example.com/hooks", "", nil}}, "webhook 'crm' needs a name, url and secret"},
+		{"repeated name", []Subscription{crm, crm}, "webhook name 'crm' is repeated"},
+		{"unknown event", []Subscription{{"crm", "https://crm.example.com/hooks", "secret", []string{"user.xablau"}}}, "webhook 'crm' has unknown event 'user.xablau'"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			err := validateSubscriptions(tc.subs)
+			if tc.err == "" && err != nil {
+				t.Errorf("expected subscriptions to be valid; got '%s'", err)
+			}
+			if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Errorf("expected error '%s'; got '%v'", tc.err, err)
+			}
+		})
+	}
+
+	if !crm.wants(WebhookUserCreated) || crm.wants(WebhookUserDeleted) {
+		t.Errorf("expected subscription to want only %v", crm.Events)
+	}
+}
+
+func TestCertThumbprint(t *testing.T) {
+	// sha256 of "xablau", base64url without padding
+	if tp := CertThumbprint([]byte("xablau")); len(tp) != 43 || strings.ContainsAny(tp, "+/=") {
+		t.Errorf("expected unpadded base64url sha256; got '%s'", tp)
+	}
+
+	ss, _, err := (&Access{Signature: "foobar", Issuer: "tester"}).newToken(User{ID: "4f1c6b1e"}, "9b2e7c4a", CertThumbprint([]byte("xablau")))
+	if err != nil {
+		t.Fatalf("could not create token: %s", err)
+	}
+
+	c, err := (&Access{Signature: "foobar", Issuer: "tester"}).ParseToken(ss)
+	if err != nil {
+		t.Fatalf("could not parse token: %s", err)
+	}
+
+	if c.Confirmation == nil || !c.BoundTo(CertThumbprint([]byte("xablau"))) || c.BoundTo("") {
+		t.Errorf("expected token bound to the thumbprint; got %v", c.Confirmation)
+	}
+}
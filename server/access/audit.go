@@ -0,0 +1,174 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// security events recorded in the audit trail
+const (
+	AuditSignup          = "signup"
+	AuditLoginSuccess    = "login.success"
+	AuditLoginFailure    = "login.failure"
+	AuditTokenIssued     = "token.issued"
+	AuditTokensRevoked   = "token.revoked"
+	AuditSessionRevoked  = "session.revoked"
+	AuditPasswordChanged = "password.changed"
+	AuditPATCreated      = "pat.created"
+	AuditPATRevoked      = "pat.revoked"
+	AuditInviteCreated   = "invite.create"
+	AuditInviteDeleted   = "invite.delete"
+	AuditWebhookRetried  = "webhook.retry"
+)
+
+// admin actions on a user account recorded in the audit trail
+const (
+	AuditUserCreate        = "user.create"
+	AuditUserDelete        = "user.delete"
+	AuditUserDisable       = "user.disable"
+	AuditUserEnable        = "user.enable"
+	AuditUserResetPassword = "user.reset_password"
+	AuditUserRevokeTokens  = "user.revoke_tokens"
+	AuditUserUnlock        = "user.unlock"
+	AuditUserRoles         = "user.roles"
+)
+
+// AuditEvent records who did what to whom, and from where.
+// Actor is the user ID behind the event, when known, and
+// Detail says more about it, like why a login failed.
+// Events are chained: Seq numbers them from 1 and Hash
+// covers the event along with the Hash of the previous one
+type AuditEvent struct {
+	Seq       int64  `json:"seq"`
+	PrevHash  string `json:"prevhash"`
+	Hash      string `json:"hash"`
+	Action    string `json:"action"`
+	Actor     string `json:"actor"`
+	Target    string `json:"target"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"useragent,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	CreatedAt int64  `json:"createdat"`
+}
+
+// AuditFilter narrows down the audit trail, zero fields match everything
+type AuditFilter struct {
+	Action string
+	Actor  string
+	Target string
+	Since  int64
+	Until  int64
+}
+
+// query - the selector of the events matching the filter
+func (f AuditFilter) query() bson.M {
+	q := bson.M{}
+	if f.Action != "" {
+		q["action"] = f.Action
+	}
+	if f.Actor != "" {
+		q["actor"] = f.Actor
+	}
+	if f.Target != "" {
+		q["target"] = f.Target
+	}
+
+	createdAt := bson.M{}
+	if f.Since != 0 {
+		createdAt["$gte"] = f.Since
+	}
+	if f.Until != 0 {
+		createdAt["$lt"] = f.Until
+	}
+	if len(createdAt) > 0 {
+		q["createdat"] = createdAt
+	}
+	return q
+}
+
+// RecordAudit - append an event to the audit chain. Events are
+// never updated nor removed, deleting a user keeps its events.
+// Checkpoints an earlier append failed to sign are signed here
+func (a Access) RecordAudit(ctx context.Context, e AuditEvent) error {
+	defer observeStorage(ctx, "record_audit")()
+
+	if e.CreatedAt == 0 {
+		e.CreatedAt = time.Now().Unix()
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	for i := 0; i < maxAuditAppends; i++ {
+		tip, err := a.auditTip()
+		if err != nil {
+			return errors.Wrap(err, "could not record audit event "+e.Action)
+		}
+
+		e = tip.link(e)
+		if err := a.auditc.Insert(e); err != nil {
+			if mgo.IsDup(err) {
+				// another server appended to the chain first
+				continue
+			}
+			return errors.Wrap(err, "could not record audit event "+e.Action)
+		}
+
+		if err := a.checkpointAudit(e); err != nil {
+			return errors.Wrap(err, "could not record audit event "+e.Action)
+		}
+
+		// a previous append may have failed to sign a checkpoint due
+		if err := a.repairCheckpoints(e); err != nil {
+			return errors.Wrap(err, "audit event "+e.Action+" recorded, could not repair checkpoints")
+		}
+		return nil
+	}
+	return fmt.Errorf("could not record audit event %s, the chain kept moving", e.Action)
+}
+
+// ListAudit - the events matching the filter, newest first, skipping
+// the first skip ones. Also returns how many events match in total
+func (a Access) ListAudit(ctx context.Context, f AuditFilter, skip, limit int) ([]AuditEvent, int, error) {
+	defer observeStorage(ctx, "list_audit")()
+
+	q := a.auditc.Find(f.query())
+
+	total, err := q.Count()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not count audit events")
+	}
+
+	events := []AuditEvent{}
+	if err := q.Sort("-seq").Skip(skip).Limit(limit).All(&events); err != nil {
+		return nil, 0, errors.Wrap(err, "could not retrieve audit events")
+	}
+	return events, total, nil
+}
+
+// ExportAudit - call fn with every event matching the filter, oldest
+// first, without loading them all at once. Stops at the first error
+func (a Access) ExportAudit(ctx context.Context, f AuditFilter, fn func(AuditEvent) error) error {
+	defer observeStorage(ctx, "export_audit")()
+
+	iter := a.auditc.Find(f.query()).Sort("seq").Iter()
+
+	e := AuditEvent{}
+	for iter.Next(&e) {
+		if err := fn(e); err != nil {
+			iter.Close()
+			return err
+		}
+		e = AuditEvent{}
+	}
+
+	if err := iter.Close(); err != nil {
+		return errors.Wrap(err, "could not retrieve audit events")
+	}
+	return nil
+}
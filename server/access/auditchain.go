@@ -0,0 +1,322 @@
+package access
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// auditCheckpointEvery is how many events go between signed checkpoints
+	auditCheckpointEvery = 100
+
+	// maxAuditAppends is how many times appending an event is tried
+	// while other servers keep appending to the chain
+	maxAuditAppends = 10
+)
+
+// auditMu serializes the appends of this process to the audit chain,
+// the unique seq index does it across servers
+var auditMu sync.Mutex
+
+// auditCheckpointed is the last seq this process knows to be
+// checkpointed, guarded by auditMu
+var auditCheckpointed int64
+
+// AuditCheckpoint vouches for the audit chain up to the event Seq.
+// Signature is made with the token signing key, so rewriting the chain
+// and recomputing its hashes is not enough to hide an edit
+type AuditCheckpoint struct {
+	Seq       int64  `json:"seq"`
+	Hash      string `json:"hash"`
+	CreatedAt int64  `json:"createdat"`
+	Signature string `json:"signature"`
+}
+
+// AuditReport sums up a verified audit chain
+type AuditReport struct {
+	Events      int64 `json:"events"`
+	Checkpoints int   `json:"checkpoints"`
+}
+
+// AuditChainError is the first broken link of the audit chain
+type AuditChainError struct {
+	Seq    int64
+	Reason string
+}
+
+func (e *AuditChainError) Error() string {
+	return fmt.Sprintf("audit chain broken at seq %d: %s", e.Seq, e.Reason)
+}
+
+// chainHash - the hash of the event, covering the hash of the previous one.
+// The fields are hashed as a JSON array, so the encoding never reorders them
+func (e AuditEvent) chainHash() string {
+	b, _ := json.Marshal([]interface{}{
+		e.Seq, e.PrevHash, e.Action, e.Actor, e.Target,
+		e.IP, e.UserAgent, e.Detail, e.CreatedAt,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// link - the event next chained after e, the zero
+// event being the tip of an empty chain
+func (e AuditEvent) link(next AuditEvent) AuditEvent {
+	next.Seq = e.Seq + 1
+	next.PrevHash = e.Hash
+	next.Hash = next.chainHash()
+	return next
+}
+
+// auditTip - the last event of the audit chain
+func (a Access) auditTip() (AuditEvent, error) {
+	tip := AuditEvent{}
+	err := a.auditc.Find(bson.M{"seq": bson.M{"$exists": true}}).Sort("-seq").One(&tip)
+	if err != nil && err != mgo.ErrNotFound {
+		return AuditEvent{}, errors.Wrap(err, "could not retrieve audit chain tip")
+	}
+	return tip, nil
+}
+
+// signCheckpoint - the signature of the checkpoint with the signing key
+func (a Access) signCheckpoint(c AuditCheckpoint) string {
+	m := hmac.New(sha256.New, []byte(a.Signature))
+	m.Write([]byte("auditcheckpoint." + strconv.FormatInt(c.Seq, 10) + "." + c.Hash + "." + strconv.FormatInt(c.CreatedAt, 10)))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// checkpointAudit - sign a checkpoint at e when it is due
+func (a Access) checkpointAudit(e AuditEvent) error {
+	if e.Seq%auditCheckpointEvery != 0 {
+		return nil
+	}
+
+	c := AuditCheckpoint{Seq: e.Seq, Hash: e.Hash, CreatedAt: time.Now().Unix()}
+	c.Signature = a.signCheckpoint(c)
+
+	if err := a.checkc.Insert(c); err != nil && !mgo.IsDup(err) {
+		return errors.Wrap(err, "could not checkpoint audit chain at seq "+strconv.FormatInt(e.Seq, 10))
+	}
+	auditCheckpointed = e.Seq
+	return nil
+}
+
+// repairCheckpoints - sign the checkpoints due up to tip that an append
+// failed to sign after recording its event. The events from the last
+// checkpoint on are checked to still link up first, a broken chain is
+// returned as an *AuditChainError and left unsigned
+func (a Access) repairCheckpoints(tip AuditEvent) error {
+	due := tip.Seq - tip.Seq%auditCheckpointEvery
+	if due == 0 || due <= auditCheckpointed {
+		return nil
+	}
+
+	n, err := a.checkc.Find(bson.M{"seq": due}).Count()
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve audit checkpoint at seq "+strconv.FormatInt(due, 10))
+	}
+	if n > 0 {
+		auditCheckpointed = due
+		return nil
+	}
+
+	var last []AuditCheckpoint
+	if err := a.checkc.Find(bson.M{"seq": bson.M{"$lt": due}}).Sort("-seq").Limit(1).All(&last); err != nil {
+		return errors.Wrap(err, "could not retrieve last audit checkpoint")
+	}
+
+	w := a.newChainWalker(last)
+	w.repair = true
+	if len(last) > 0 {
+		e := AuditEvent{}
+		if err := a.auditc.Find(bson.M{"seq": last[0].Seq}).One(&e); err != nil {
+			return errors.Wrap(err, "could not retrieve checkpointed audit event")
+		}
+		if err := w.checkpoint(last[0], e); err != nil {
+			return err
+		}
+		w.tip = e
+	}
+
+	iter := a.auditc.Find(bson.M{"seq": bson.M{"$gt": w.tip.Seq, "$lte": due}}).Sort("seq").Iter()
+
+	e := AuditEvent{}
+	for iter.Next(&e) {
+		if err := w.next(e); err != nil {
+			iter.Close()
+			return err
+		}
+		e = AuditEvent{}
+	}
+
+	if err := iter.Close(); err != nil {
+		return errors.Wrap(err, "could not retrieve audit events")
+	}
+	return nil
+}
+
+// MigrateAudit - chain the events recorded before the audit chain
+// existed, in the order they were recorded, after its tip. Returns
+// how many events were chained, running it again is a no-op
+func (a Access) MigrateAudit(ctx context.Context) (int, error) {
+	defer observeStorage(ctx, "migrate_audit")()
+
+	var legacy []struct {
+		OID        bson.ObjectId `bson:"_id"`
+		AuditEvent `bson:",inline"`
+	}
+
+	if err := a.auditc.Find(bson.M{"seq": bson.M{"$exists": false}}).Sort("createdat", "_id").All(&legacy); err != nil {
+		return 0, errors.Wrap(err, "could not retrieve unchained audit events")
+	}
+
+	if len(legacy) == 0 {
+		return 0, nil
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	tip, err := a.auditTip()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, l := range legacy {
+		tip = tip.link(l.AuditEvent)
+		set := bson.M{"seq": tip.Seq, "prevhash": tip.PrevHash, "hash": tip.Hash}
+		if err := a.auditc.UpdateId(l.OID, bson.M{"$set": set}); err != nil {
+			return i, errors.Wrap(err, "could not chain audit event "+l.OID.Hex())
+		}
+
+		if err := a.checkpointAudit(tip); err != nil {
+			return i + 1, err
+		}
+	}
+	return len(legacy), nil
+}
+
+// VerifyAudit - walk the audit chain checking every event follows
+// the previous one and matches its hash, and that a signed checkpoint
+// is there for every one due and agrees with it. Events out of the
+// chain are tampering too, MigrateAudit chains the legacy ones. The
+// DB is only read. The first broken link is returned as an *AuditChainError
+func (a Access) VerifyAudit(ctx context.Context) (AuditReport, error) {
+	defer observeStorage(ctx, "verify_audit")()
+
+	var checkpoints []AuditCheckpoint
+	if err := a.checkc.Find(nil).All(&checkpoints); err != nil {
+		return AuditReport{}, errors.Wrap(err, "could not retrieve audit checkpoints")
+	}
+
+	w := a.newChainWalker(checkpoints)
+
+	iter := a.auditc.Find(nil).Sort("seq", "_id").Iter()
+
+	e := AuditEvent{}
+	for iter.Next(&e) {
+		if err := w.next(e); err != nil {
+			iter.Close()
+			return w.report(), err
+		}
+		e = AuditEvent{}
+	}
+
+	if err := iter.Close(); err != nil {
+		return w.report(), errors.Wrap(err, "could not retrieve audit events")
+	}
+	return w.report(), w.finish()
+}
+
+// chainWalker checks audit events one at a time, in seq order
+type chainWalker struct {
+	a           Access
+	checkpoints map[int64]AuditCheckpoint
+	tip         AuditEvent
+	verified    int
+
+	// repair signs the checkpoints missing instead of failing
+	repair bool
+}
+
+func (a Access) newChainWalker(checkpoints []AuditCheckpoint) *chainWalker {
+	m := make(map[int64]AuditCheckpoint, len(checkpoints))
+	for _, c := range checkpoints {
+		m[c.Seq] = c
+	}
+	return &chainWalker{a: a, checkpoints: m}
+}
+
+// next - check e is the link after the previous event
+func (w *chainWalker) next(e AuditEvent) error {
+	switch {
+	case e.Seq == 0:
+		return &AuditChainError{w.tip.Seq + 1, "event out of the chain"}
+	case e.Seq != w.tip.Seq+1:
+		return &AuditChainError{w.tip.Seq + 1, fmt.Sprintf("expected seq %d; found %d", w.tip.Seq+1, e.Seq)}
+	case e.PrevHash != w.tip.Hash:
+		return &AuditChainError{e.Seq, "previous hash does not match"}
+	case e.Hash != e.chainHash():
+		return &AuditChainError{e.Seq, "hash does not match the event"}
+	}
+
+	c, ok := w.checkpoints[e.Seq]
+	switch {
+	case ok:
+		if err := w.checkpoint(c, e); err != nil {
+			return err
+		}
+		w.verified++
+	case e.Seq%auditCheckpointEvery == 0 && w.repair:
+		if err := w.a.checkpointAudit(e); err != nil {
+			return err
+		}
+	case e.Seq%auditCheckpointEvery == 0:
+		return &AuditChainError{e.Seq, "checkpoint missing"}
+	}
+
+	w.tip = e
+	return nil
+}
+
+// checkpoint - check the checkpoint is signed and vouches for e
+func (w *chainWalker) checkpoint(c AuditCheckpoint, e AuditEvent) error {
+	if !hmac.Equal([]byte(c.Signature), []byte(w.a.signCheckpoint(c))) {
+		return &AuditChainError{c.Seq, "checkpoint signature does not match"}
+	}
+	if c.Hash != e.Hash {
+		return &AuditChainError{c.Seq, "checkpoint hash does not match"}
+	}
+	return nil
+}
+
+// finish - check no checkpoint vouches for events past the end of the
+// chain. Events removed from the end after the last checkpoint go unseen
+func (w *chainWalker) finish() error {
+	var missing int64
+	for seq := range w.checkpoints {
+		if seq > w.tip.Seq && (missing == 0 || seq < missing) {
+			missing = seq
+		}
+	}
+
+	if missing != 0 {
+		return &AuditChainError{w.tip.Seq + 1, fmt.Sprintf("events missing, checkpoint at seq %d", missing)}
+	}
+	return nil
+}
+
+func (w *chainWalker) report() AuditReport {
+	return AuditReport{Events: w.tip.Seq, Checkpoints: w.verified}
+}
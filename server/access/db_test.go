@@ -0,0 +1,171 @@
+package access
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testAccess grants access to a scratch db on the mongodb at AUTH_TEST_DB,
+// dropped when the test ends. Tests needing it are skipped without one
+func testAccess(t *testing.T) *Access {
+	addr := os.Getenv("AUTH_TEST_DB")
+	if addr == "" {
+		t.Skip("AUTH_TEST_DB not set")
+	}
+
+	sess, err := mgo.Dial(addr)
+	if err != nil {
+		t.Fatalf("could not connect to test db: %s", err)
+	}
+
+	db := sess.DB("authtest_" + newID()[:8])
+	t.Cleanup(func() {
+		db.DropDatabase()
+		sess.Close()
+	})
+
+	c := &conn{sess, db.C("user"), db.C("token"), db.C("audit"), db.C("auditcheckpoint"),
+		db.C("session"), db.C("pat"), db.C("magiclink"), db.C("invite"), db.C("webhook")}
+	a := &Access{conn: c, Signature: "foobar", Issuer: "tester", SessionIdle: defaultSessionIdle,
+		SessionMaxAge: defaultSessionMaxAge, MagicLinkTTL: defaultMagicLinkTTL}
+
+	if err := a.ensureIndexes(); err != nil {
+		t.Fatalf("could not ensure test db indexes: %s", err)
+	}
+	return a
+}
+
+func TestReenabledUserTokens(t *testing.T) {
+	a := testAccess(t)
+	ctx := context.Background()
+
+	u, err := a.RegisterUser(ctx, "gopher", "gopher@foomail.com", "hash")
+	if err != nil {
+		t.Fatalf("could not register user: %s", err)
+	}
+
+	ss, _, err := a.IssueToken(ctx, u, Device{UserAgent: "test"})
+	if err != nil {
+		t.Fatalf("could not issue token: %s", err)
+	}
+	session, err := a.NewSession(ctx, u.ID, Device{UserAgent: "test"})
+	if err != nil {
+		t.Fatalf("could not start session: %s", err)
+	}
+	pat, _, err := a.NewPersonalToken(ctx, u, "ci", nil, 0)
+	if err != nil {
+		t.Fatalf("could not create personal token: %s", err)
+	}
+
+	if err := a.SetDisabled(ctx, u.ID, true); err != nil {
+		t.Fatalf("could not disable user: %s", err)
+	}
+	if err := a.SetDisabled(ctx, u.ID, false); err != nil {
+		t.Fatalf("could not enable user: %s", err)
+	}
+
+	c, err := a.ParseToken(ss)
+	if err != nil {
+		t.Fatalf("could not parse token: %s", err)
+	}
+	if err := a.VerifyClaim(ctx, c); errors.Cause(err) != ErrTokenRevoked {
+		t.Errorf("expected token issued before disabling to be revoked; got %v", err)
+	}
+	if _, _, err := a.SessionUser(ctx, session); err == nil {
+		t.Errorf("expected session started before disabling to be gone")
+	}
+	if _, err := a.VerifyPersonalToken(ctx, pat); errors.Cause(err) != ErrTokenRevoked {
+		t.Errorf("expected personal token created before disabling to be revoked; got %v", err)
+	}
+}
+
+func TestRepairAuditCheckpoints(t *testing.T) {
+	tt := []struct {
+		label  string
+		tamper bool
+	}{
+		{"intact", false},
+		{"edited", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			a := testAccess(t)
+			ctx := context.Background()
+
+			// an append that recorded seq 100 but failed to checkpoint it
+			tip := AuditEvent{}
+			for i := 1; i <= auditCheckpointEvery; i++ {
+				tip = tip.link(AuditEvent{Action: AuditLoginSuccess, Actor: "4f1c6b1e", CreatedAt: int64(i)})
+				if err := a.auditc.Insert(tip); err != nil {
+					t.Fatalf("could not insert audit event: %s", err)
+				}
+			}
+			if tc.tamper {
+				a.auditc.Update(bson.M{"seq": 50}, bson.M{"$set": bson.M{"actor": "9b2e7c4a"}})
+			}
+			auditCheckpointed = 0
+
+			err := a.RecordAudit(ctx, AuditEvent{Action: AuditLoginSuccess, Actor: "4f1c6b1e"})
+			if _, broken := errors.Cause(err).(*AuditChainError); broken != tc.tamper {
+				t.Fatalf("expected broken chain %v; got %v", tc.tamper, err)
+			}
+
+			n, _ := a.checkc.Find(bson.M{"seq": auditCheckpointEvery}).Count()
+			if (n == 1) == tc.tamper {
+				t.Errorf("expected checkpoint signed %v; got %d checkpoints", !tc.tamper, n)
+			}
+
+			if _, err := a.VerifyAudit(ctx); (err == nil) == tc.tamper {
+				t.Errorf("expected verify to fail %v; got %v", tc.tamper, err)
+			}
+		})
+	}
+}
+
+func TestVerifyUnknownPersonalToken(t *testing.T) {
+	a := testAccess(t)
+
+	if _, err := a.VerifyPersonalToken(context.Background(), "pat_xablau"); errors.Cause(err) != ErrTokenRevoked {
+		t.Errorf("expected unknown personal token to be revoked; got %v", err)
+	}
+}
+
+func TestRevokeOneToken(t *testing.T) {
+	a := testAccess(t)
+	ctx := context.Background()
+
+	u, err := a.RegisterUser(ctx, "gopher", "gopher@foomail.com", "hash")
+	if err != nil {
+		t.Fatalf("could not register user: %s", err)
+	}
+
+	var claims []*Claim
+	for i := 0; i < 2; i++ {
+		ss, _, err := a.IssueToken(ctx, u, Device{UserAgent: "test"})
+		if err != nil {
+			t.Fatalf("could not issue token: %s", err)
+		}
+		c, err := a.ParseToken(ss)
+		if err != nil {
+			t.Fatalf("could not parse token: %s", err)
+		}
+		claims = append(claims, c)
+	}
+
+	if err := a.RevokeToken(ctx, u.ID, claims[0].Id); err != nil {
+		t.Fatalf("could not revoke token: %s", err)
+	}
+
+	if err := a.VerifyClaim(ctx, claims[0]); errors.Cause(err) != ErrTokenRevoked {
+		t.Errorf("expected revoked token to be revoked; got %v", err)
+	}
+	if err := a.VerifyClaim(ctx, claims[1]); err != nil {
+		t.Errorf("expected other token to stay valid; got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrInvalidInvite is returned for unknown, expired or already used invites
+var ErrInvalidInvite = errors.New("invalid invite")
+
+// Invite wraps a single use code admins hand out to let someone sign up
+// while signup is invite only. Only the hash of the code is stored.
+// Invites with an Email can only be redeemed by signing up with it
+type Invite struct {
+	ID        string `json:"id"`
+	Hash      string `json:"-"`
+	Email     string `json:"email,omitempty"`
+	CreatedBy string `json:"createdby"`
+	CreatedAt int64  `json:"createdat"`
+	ExpiresAt int64  `json:"expiresat"`
+	UsedAt    int64  `json:"usedat,omitempty"`
+	UsedBy    string `json:"usedby,omitempty"`
+}
+
+// NewInvite - create an invite by the admin createdBy, expiring
+// at expiresAt and optionally bound to an email. The code is
+// returned along with the invite record
+func (a Access) NewInvite(ctx context.Context, createdBy, email string, expiresAt int64) (string, Invite, error) {
+	defer observeStorage(ctx, "new_invite")()
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", Invite{}, errors.Wrap(err, "could not generate invite code")
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+
+	inv := Invite{
+		ID:        newID(),
+		Hash:      hashSecret(code),
+		Email:     strings.ToLower(email),
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: expiresAt,
+	}
+
+	if err := a.invitec.Insert(inv); err != nil {
+		return "", Invite{}, errors.Wrap(err, "could not insert invite")
+	}
+	return code, inv, nil
+}
+
+// ListInvites - every invite, newest first
+func (a Access) ListInvites(ctx context.Context) ([]Invite, error) {
+	defer observeStorage(ctx, "list_invites")()
+
+	invites := []Invite{}
+	if err := a.invitec.Find(nil).Sort("-createdat").All(&invites); err != nil {
+		return nil, errors.Wrap(err, "could not retrieve invites")
+	}
+	return invites, nil
+}
+
+// DeleteInvite - remove the invite with the given ID
+func (a Access) DeleteInvite(ctx context.Context, id string) error {
+	defer observeStorage(ctx, "delete_invite")()
+
+	if err := a.invitec.Remove(bson.M{"id": id}); err != nil {
+		return errors.Wrap(err, "could not delete invite "+id)
+	}
+	return nil
+}
+
+// RedeemInvite - mark the invite with the given code as used for
+// signing up with email. It is found and marked in one operation,
+// so each code lets a single user in
+func (a Access) RedeemInvite(ctx context.Context, code, email string) (Invite, error) {
+	defer observeStorage(ctx, "redeem_invite")()
+
+	now := time.Now().Unix()
+	sel := bson.M{
+		"hash":      hashSecret(code),
+		"usedat":    0,
+		"expiresat": bson.M{"$gt": now},
+		"email":     bson.M{"$in": []string{"", strings.ToLower(email)}},
+	}
+
+	inv := Invite{}
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"usedat": now, "usedby": email}}, ReturnNew: true}
+	if _, err := a.invitec.Find(sel).Apply(change, &inv); err != nil {
+		if err == mgo.ErrNotFound {
+			return Invite{}, ErrInvalidInvite
+		}
+		return Invite{}, errors.Wrap(err, "could not redeem invite")
+	}
+	return inv, nil
+}
+
+// ReleaseInvite - make a redeemed invite usable again,
+// for signups that failed after redeeming it
+func (a Access) ReleaseInvite(ctx context.Context, id string) error {
+	defer observeStorage(ctx, "release_invite")()
+
+	if err := a.invitec.Update(bson.M{"id": id}, bson.M{"$set": bson.M{"usedat": 0, "usedby": ""}}); err != nil {
+		return errors.Wrap(err, "could not release invite "+id)
+	}
+	return nil
+}
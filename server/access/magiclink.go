@@ -0,0 +1,162 @@
+package access
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// defaultMagicLinkTTL is how long a login link stays usable
+	defaultMagicLinkTTL = 15 * time.Minute
+
+	// magicLinkInterval is how long a user waits between login links
+	magicLinkInterval = time.Minute
+)
+
+var (
+	// ErrInvalidMagicLink is returned for forged, expired or already used login links
+	ErrInvalidMagicLink = errors.New("invalid magic link")
+
+	// ErrMagicLinkTooSoon is returned when the user got a login link less than magicLinkInterval ago
+	ErrMagicLinkTooSoon = errors.New("magic link requested too soon")
+)
+
+// MagicLink wraps a login link sent by email. The link carries a secret
+// signed with the token signature, of which only the hash is stored
+type MagicLink struct {
+	Hash      string `json:"-"`
+	UserID    string `json:"userid"`
+	CreatedAt int64  `json:"createdat"`
+	ExpiresAt int64  `json:"expiresat"`
+}
+
+// tooSoon - whether the link was created less than magicLinkInterval before now
+func (l MagicLink) tooSoon(now time.Time) bool {
+	return now.Unix()-l.CreatedAt < int64(magicLinkInterval.Seconds())
+}
+
+// NewMagicLink - create a login link secret for the user, usable once
+// before MagicLinkTTL passes. Links sent to the user earlier stop working.
+// Returns ErrMagicLinkTooSoon if the previous one is newer than magicLinkInterval
+func (a Access) NewMagicLink(ctx context.Context, u User) (string, error) {
+	defer observeStorage(ctx, "new_magic_link")()
+
+	prev := MagicLink{}
+	err := a.magicc.Find(bson.M{"userid": u.ID}).Sort("-createdat").One(&prev)
+	if err != nil && err != mgo.ErrNotFound {
+		return "", errors.Wrap(err, "could not retrieve previous magic link for user "+u.Email)
+	}
+	if err == nil && prev.tooSoon(time.Now()) {
+		return "", ErrMagicLinkTooSoon
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "could not generate magic link secret")
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	secret := nonce + "." + a.signMagicLink(nonce)
+
+	now := time.Now()
+	if _, err := a.magicc.RemoveAll(bson.M{"$or": []bson.M{
+		{"userid": u.ID},
+		{"expiresat": bson.M{"$lte": now.Unix()}},
+	}}); err != nil {
+		return "", errors.Wrap(err, "could not remove previous magic links for user "+u.Email)
+	}
+
+	l := MagicLink{
+		Hash:      hashSecret(secret),
+		UserID:    u.ID,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(a.MagicLinkTTL).Unix(),
+	}
+
+	if err := a.magicc.Insert(l); err != nil {
+		return "", errors.Wrap(err, "could not insert magic link for user "+u.Email)
+	}
+	return secret, nil
+}
+
+// MagicLinkOwner - the owner of the login link secret, leaving
+// the link usable. Fails as ConsumeMagicLink does
+func (a Access) MagicLinkOwner(ctx context.Context, secret string) (User, error) {
+	defer observeStorage(ctx, "magic_link_owner")()
+
+	if !a.validMagicLink(secret) {
+		return User{}, ErrInvalidMagicLink
+	}
+
+	l := MagicLink{}
+	if err := a.magicc.Find(magicLinkSelector(secret)).One(&l); err != nil {
+		if err == mgo.ErrNotFound {
+			return User{}, ErrInvalidMagicLink
+		}
+		return User{}, errors.Wrap(err, "could not retrieve magic link")
+	}
+	return a.magicLinkUser(ctx, l)
+}
+
+// ConsumeMagicLink - trade the login link secret for its owner. The link
+// is removed in the same operation it is found, so it works only once
+func (a Access) ConsumeMagicLink(ctx context.Context, secret string) (User, error) {
+	defer observeStorage(ctx, "consume_magic_link")()
+
+	if !a.validMagicLink(secret) {
+		return User{}, ErrInvalidMagicLink
+	}
+
+	l := MagicLink{}
+	if _, err := a.magicc.Find(magicLinkSelector(secret)).Apply(mgo.Change{Remove: true}, &l); err != nil {
+		if err == mgo.ErrNotFound {
+			return User{}, ErrInvalidMagicLink
+		}
+		return User{}, errors.Wrap(err, "could not consume magic link")
+	}
+	return a.magicLinkUser(ctx, l)
+}
+
+// magicLinkSelector - the query for the unexpired link with the given secret
+func magicLinkSelector(secret string) bson.M {
+	return bson.M{"hash": hashSecret(secret), "expiresat": bson.M{"$gt": time.Now().Unix()}}
+}
+
+// magicLinkUser - the owner of the link, failing for disabled users
+func (a Access) magicLinkUser(ctx context.Context, l MagicLink) (User, error) {
+	u, err := a.FindUserByID(ctx, l.UserID)
+	if err != nil {
+		return User{}, errors.Wrap(err, "could not find magic link owner")
+	}
+
+	if u.Disabled {
+		return User{}, fmt.Errorf("user %s is disabled", u.ID)
+	}
+	return u, nil
+}
+
+// signMagicLink - the signature of the login link nonce
+func (a Access) signMagicLink(nonce string) string {
+	m := hmac.New(sha256.New, []byte(a.Signature))
+	m.Write([]byte("magiclink." + nonce))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// validMagicLink - check the signature of the login link secret,
+// so forged links are turned down without a db lookup
+func (a Access) validMagicLink(secret string) bool {
+	i := strings.LastIndex(secret, ".")
+	if i < 1 {
+		return false
+	}
+	return hmac.Equal([]byte(secret[i+1:]), []byte(a.signMagicLink(secret[:i])))
+}
@@ -0,0 +1,153 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// personalTokenPrefix tells personal access tokens apart from JWTs
+const personalTokenPrefix = "pat_"
+
+// PersonalToken wraps a long lived token users create for scripts and CI.
+// Only the hash of the secret is stored, the secret is shown once
+type PersonalToken struct {
+	ID         string   `json:"id"`
+	UserID     string   `json:"userid"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	Hash       string   `json:"-"`
+	CreatedAt  int64    `json:"createdat"`
+	LastUsedAt int64    `json:"lastusedat"`
+	ExpiresAt  int64    `json:"expiresat"`
+}
+
+// Expired - check if the token is past its expiration at the given
+// time, tokens without one never expire
+func (t PersonalToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != 0 && now.Unix() >= t.ExpiresAt
+}
+
+// IsPersonalToken - check if the bearer token ss is a personal access token
+func IsPersonalToken(ss string) bool {
+	return strings.HasPrefix(ss, personalTokenPrefix)
+}
+
+// NewPersonalToken - create a personal access token for the user limited
+// to scopes, which must be permissions the user has. A zero expiresAt
+// never expires. The secret is returned along with the token record
+func (a Access) NewPersonalToken(ctx context.Context, u User, name string, scopes []string, expiresAt int64) (string, PersonalToken, error) {
+	defer observeStorage(ctx, "new_personal_token")()
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", PersonalToken{}, errors.Wrap(err, "could not generate personal token secret")
+	}
+	secret := personalTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	now := time.Now().Unix()
+	t := PersonalToken{
+		ID:        newID(),
+		UserID:    u.ID,
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashSecret(secret),
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+
+	if err := a.patc.Insert(t); err != nil {
+		return "", PersonalToken{}, errors.Wrap(err, "could not insert personal token for user "+u.Email)
+	}
+	return secret, t, nil
+}
+
+// ListPersonalTokens - the personal access tokens of the user, newest first
+func (a Access) ListPersonalTokens(ctx context.Context, userID string) ([]PersonalToken, error) {
+	defer observeStorage(ctx, "list_personal_tokens")()
+
+	tokens := []PersonalToken{}
+	if err := a.patc.Find(bson.M{"userid": userID}).Sort("-createdat").All(&tokens); err != nil {
+		return nil, errors.Wrap(err, "could not retrieve personal tokens for user "+userID)
+	}
+	return tokens, nil
+}
+
+// RevokePersonalToken - delete the personal access token
+// with the given ID, as long as it belongs to the user
+func (a Access) RevokePersonalToken(ctx context.Context, userID, id string) error {
+	defer observeStorage(ctx, "revoke_personal_token")()
+
+	if err := a.patc.Remove(bson.M{"id": id, "userid": userID}); err != nil {
+		return errors.Wrap(err, "could not revoke personal token "+id)
+	}
+	return nil
+}
+
+// VerifyPersonalToken - check the personal access token secret and
+// return the claims a JWT of its owner would have, with only the
+// permissions that are both in the token scopes and granted to the
+// owner, and no roles. Its last used time is updated. Tokens unknown,
+// expired or whose owner is gone or inactive return ErrTokenRevoked as
+// the cause, other errors mean the DB could not tell
+func (a Access) VerifyPersonalToken(ctx context.Context, secret string) (*Claim, error) {
+	defer observeStorage(ctx, "verify_personal_token")()
+
+	sel := bson.M{"hash": hashSecret(secret)}
+
+	t := PersonalToken{}
+	err := a.patc.Find(sel).One(&t)
+	if err == mgo.ErrNotFound {
+		return nil, errors.Wrap(ErrTokenRevoked, "personal token not found")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve personal token")
+	}
+
+	now := time.Now()
+	if t.Expired(now) {
+		return nil, errors.Wrapf(ErrTokenRevoked, "personal token %s expired at %d", t.ID, t.ExpiresAt)
+	}
+
+	u, err := a.FindUserByID(ctx, t.UserID)
+	if errors.Cause(err) == mgo.ErrNotFound {
+		return nil, errors.Wrapf(ErrTokenRevoked, "personal token owner %s not found", t.UserID)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not find personal token owner")
+	}
+
+	if err := activeUser(u); err != nil {
+		return nil, errors.Wrap(ErrTokenRevoked, err.Error())
+	}
+
+	if now.Unix()-t.LastUsedAt >= int64(touchInterval.Seconds()) {
+		if err := a.patc.Update(sel, bson.M{"$set": bson.M{"lastusedat": now.Unix()}}); err != nil && err != mgo.ErrNotFound {
+			return nil, errors.Wrap(err, "could not touch personal token "+t.ID)
+		}
+	}
+
+	return &Claim{
+		User:        u.Name,
+		Email:       u.Email,
+		Permissions: u.ScopedPermissions(t.Scopes),
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: t.ExpiresAt,
+			IssuedAt:  t.CreatedAt,
+			Issuer:    a.Issuer,
+			Subject:   u.ID,
+			Id:        t.ID,
+		},
+	}, nil
+}
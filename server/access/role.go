@@ -0,0 +1,165 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// RoleAdmin is granted every permission
+	RoleAdmin = "admin"
+
+	// RoleUser is the role given to every registered user
+	RoleUser = "user"
+)
+
+const (
+	// PermUsersRead allows to look up user accounts
+	PermUsersRead = "users:read"
+
+	// PermUsersWrite allows to modify user accounts
+	PermUsersWrite = "users:write"
+
+	// PermRolesWrite allows to assign roles and permissions
+	PermRolesWrite = "roles:write"
+
+	// PermAuditRead allows to query and export the audit trail
+	PermAuditRead = "audit:read"
+)
+
+// rolePermissions maps each known role to the permissions it grants
+var rolePermissions = map[string][]string{
+	RoleAdmin: {PermAuditRead, PermUsersRead, PermUsersWrite, PermRolesWrite},
+	RoleUser:  {},
+}
+
+// ValidateRoles - return an error if any of roles is unknown
+func ValidateRoles(roles []string) error {
+	for _, r := range roles {
+		if _, ok := rolePermissions[r]; !ok {
+			return fmt.Errorf("unknown role '%s'", r)
+		}
+	}
+	return nil
+}
+
+// ValidatePermissions - return an error if any of perms
+// is not granted by at least one role
+func ValidatePermissions(perms []string) error {
+	for _, p := range perms {
+		if !knownPermission(p) {
+			return fmt.Errorf("unknown permission '%s'", p)
+		}
+	}
+	return nil
+}
+
+// EffectivePermissions - the sorted union of the permissions
+// granted by the user roles and the ones assigned directly
+func (u User) EffectivePermissions() []string {
+	set := map[string]bool{}
+	for _, r := range u.EffectiveRoles() {
+		for _, p := range rolePermissions[r] {
+			set[p] = true
+		}
+	}
+
+	for _, p := range u.Permissions {
+		set[p] = true
+	}
+
+	perms := make([]string, 0, len(set))
+	for p := range set {
+		perms = append(perms, p)
+	}
+	sort.Strings(perms)
+	return perms
+}
+
+// ScopedPermissions - the effective permissions of the user that are in scopes
+func (u User) ScopedPermissions(scopes []string) []string {
+	granted := map[string]bool{}
+	for _, p := range u.EffectivePermissions() {
+		granted[p] = true
+	}
+
+	perms := []string{}
+	for _, s := range scopes {
+		if granted[s] {
+			perms = append(perms, s)
+		}
+	}
+	return perms
+}
+
+// restrictTo - drop the roles and permissions of the claim the user
+// no longer has, so tokens don't outlive a change of roles
+func (c *Claim) restrictTo(u User) {
+	c.Permissions = u.ScopedPermissions(c.Permissions)
+
+	current := map[string]bool{}
+	for _, r := range u.EffectiveRoles() {
+		current[r] = true
+	}
+
+	roles := []string{}
+	for _, r := range c.Roles {
+		if current[r] {
+			roles = append(roles, r)
+		}
+	}
+	c.Roles = roles
+}
+
+// EffectiveRoles - the user roles, users registered
+// before roles existed are plain users
+func (u User) EffectiveRoles() []string {
+	if len(u.Roles) == 0 {
+		return []string{RoleUser}
+	}
+	return u.Roles
+}
+
+// HasPermission - check if the claim grants permission perm
+func (c Claim) HasPermission(perm string) bool {
+	for _, p := range c.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRoles - replace the roles and directly assigned permissions of a user
+func (a Access) SetRoles(ctx context.Context, userID string, roles, perms []string) error {
+	defer observeStorage(ctx, "set_roles")()
+
+	if err := ValidateRoles(roles); err != nil {
+		return errors.Wrap(err, "roles validation failed")
+	}
+
+	if err := ValidatePermissions(perms); err != nil {
+		return errors.Wrap(err, "permissions validation failed")
+	}
+
+	change := bson.M{"$set": bson.M{"roles": roles, "permissions": perms}}
+	if err := a.userc.Update(bson.M{"id": userID}, change); err != nil {
+		return errors.Wrap(err, "could not set roles for user "+userID)
+	}
+	return nil
+}
+
+func knownPermission(perm string) bool {
+	for _, perms := range rolePermissions {
+		for _, p := range perms {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
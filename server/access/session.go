@@ -0,0 +1,237 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// defaultSessionIdle is how long a session survives without being used
+	defaultSessionIdle = 30 * time.Minute
+
+	// defaultSessionMaxAge is how long a session survives no matter what
+	defaultSessionMaxAge = 24 * time.Hour
+)
+
+// kinds of active sessions
+const (
+	KindBrowser = "browser"
+	KindToken   = "token"
+)
+
+// ErrSessionExpired is returned for sessions past their idle or absolute timeout
+var ErrSessionExpired = errors.New("session expired")
+
+// Session wraps a browser login. The browser holds a secret of which
+// only the hash is stored, so the sessions collection alone can't be
+// used to log in. ID identifies the session to its owner
+type Session struct {
+	ID         string `json:"id"`
+	Hash       string `json:"-"`
+	UserID     string `json:"userid"`
+	Device     Device `json:"device"`
+	CreatedAt  int64  `json:"createdat"`
+	LastUsedAt int64  `json:"lastusedat"`
+}
+
+// ActiveSession is a browser session or a token in use by a user
+type ActiveSession struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	UserAgent  string `json:"useragent"`
+	IP         string `json:"ip"`
+	CreatedAt  int64  `json:"createdat"`
+	LastUsedAt int64  `json:"lastusedat"`
+	ExpiresAt  int64  `json:"expiresat"`
+}
+
+// Expired - check if the session is past the idle or absolute timeout at the given time
+func (s Session) Expired(now time.Time, idle, maxAge time.Duration) bool {
+	return now.Unix() > s.expiresAt(idle, maxAge)
+}
+
+// expiresAt - when the session expires unless used again
+func (s Session) expiresAt(idle, maxAge time.Duration) int64 {
+	idleAt := s.LastUsedAt + int64(idle.Seconds())
+	if maxAt := s.CreatedAt + int64(maxAge.Seconds()); maxAt < idleAt {
+		return maxAt
+	}
+	return idleAt
+}
+
+// NewSession - start a session for the user on the given device,
+// returning the secret to hand out to the browser
+func (a Access) NewSession(ctx context.Context, userID string, d Device) (string, error) {
+	defer observeStorage(ctx, "new_session")()
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "could not generate session secret")
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().Unix()
+	s := Session{
+		ID:         newID(),
+		Hash:       hashSecret(secret),
+		UserID:     userID,
+		Device:     d,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+
+	if err := a.sessionc.Insert(s); err != nil {
+		return "", errors.Wrap(err, "could not insert session for user "+userID)
+	}
+	return secret, nil
+}
+
+// FindSession - retrieve the session with the given secret, extending its
+// idle timeout. Expired sessions are removed and ErrSessionExpired returned
+func (a Access) FindSession(ctx context.Context, secret string) (Session, error) {
+	defer observeStorage(ctx, "find_session")()
+
+	sel := bson.M{"hash": hashSecret(secret)}
+
+	s := Session{}
+	if err := a.sessionc.Find(sel).One(&s); err != nil {
+		return Session{}, errors.Wrap(err, "could not retrieve session")
+	}
+
+	now := time.Now()
+	if s.Expired(now, a.SessionIdle, a.SessionMaxAge) {
+		if err := a.sessionc.Remove(sel); err != nil && err != mgo.ErrNotFound {
+			return Session{}, errors.Wrap(err, "could not remove expired session")
+		}
+		return Session{}, ErrSessionExpired
+	}
+
+	if now.Unix()-s.LastUsedAt < int64(touchInterval.Seconds()) {
+		return s, nil
+	}
+
+	if err := a.sessionc.Update(sel, bson.M{"$set": bson.M{"lastusedat": now.Unix()}}); err != nil {
+		return Session{}, errors.Wrap(err, "could not touch session")
+	}
+	s.LastUsedAt = now.Unix()
+	return s, nil
+}
+
+// SessionUser - retrieve the session with the given secret and its owner,
+// failing for expired sessions, disabled users and users who must reset
+// their password
+func (a Access) SessionUser(ctx context.Context, secret string) (User, Session, error) {
+	defer observeStorage(ctx, "session_user")()
+
+	s, err := a.FindSession(ctx, secret)
+	if err != nil {
+		return User{}, Session{}, err
+	}
+
+	u, err := a.FindUserByID(ctx, s.UserID)
+	if err != nil {
+		return User{}, Session{}, errors.Wrap(err, "could not find session owner")
+	}
+
+	if err := activeUser(u); err != nil {
+		return User{}, Session{}, err
+	}
+	return u, s, nil
+}
+
+// activeUser - whether the user may keep using a browser session
+// or a personal access token
+func activeUser(u User) error {
+	if u.Disabled {
+		return fmt.Errorf("user %s is disabled", u.ID)
+	}
+	if u.PasswordResetRequired {
+		return fmt.Errorf("user %s must reset the password", u.ID)
+	}
+	return nil
+}
+
+// DeleteSession - end the session with the given secret, unknown secrets are not an error
+func (a Access) DeleteSession(ctx context.Context, secret string) error {
+	defer observeStorage(ctx, "delete_session")()
+
+	if err := a.sessionc.Remove(bson.M{"hash": hashSecret(secret)}); err != nil && err != mgo.ErrNotFound {
+		return errors.Wrap(err, "could not remove session")
+	}
+	return nil
+}
+
+// ListSessions - the unexpired browser sessions and tokens
+// of the user, the most recently used first
+func (a Access) ListSessions(ctx context.Context, userID string) ([]ActiveSession, error) {
+	defer observeStorage(ctx, "list_sessions")()
+
+	now := time.Now()
+
+	var sessions []Session
+	if err := a.sessionc.Find(bson.M{"userid": userID}).All(&sessions); err != nil {
+		return nil, errors.Wrap(err, "could not retrieve sessions for user "+userID)
+	}
+
+	var tokens []IssuedToken
+	if err := a.tokenc.Find(bson.M{"userid": userID, "expiresat": bson.M{"$gt": now.Unix()}}).All(&tokens); err != nil {
+		return nil, errors.Wrap(err, "could not retrieve tokens for user "+userID)
+	}
+
+	active := make([]ActiveSession, 0, len(sessions)+len(tokens))
+	for _, s := range sessions {
+		if s.Expired(now, a.SessionIdle, a.SessionMaxAge) {
+			continue
+		}
+		active = append(active, ActiveSession{
+			s.ID, KindBrowser, s.Device.UserAgent, s.Device.IP,
+			s.CreatedAt, s.LastUsedAt, s.expiresAt(a.SessionIdle, a.SessionMaxAge),
+		})
+	}
+
+	for _, t := range tokens {
+		active = append(active, ActiveSession{
+			t.ID, KindToken, t.Device.UserAgent, t.Device.IP,
+			t.CreatedAt, t.LastUsedAt, t.ExpiresAt,
+		})
+	}
+
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].LastUsedAt > active[j].LastUsedAt
+	})
+	return active, nil
+}
+
+// RevokeSession - end the browser session or revoke the token
+// with the given ID, as long as it belongs to the user
+func (a Access) RevokeSession(ctx context.Context, userID, id string) error {
+	defer observeStorage(ctx, "revoke_session")()
+
+	sel := bson.M{"id": id, "userid": userID}
+
+	err := a.sessionc.Remove(sel)
+	if err == mgo.ErrNotFound {
+		err = a.tokenc.Remove(sel)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not revoke session "+id)
+	}
+	return nil
+}
+
+// hashSecret - the key sessions and personal tokens are stored
+// under, the secrets are random enough for a plain hash to do
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,129 @@
+package access
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// touchInterval limits how often last used times are written
+const touchInterval = time.Minute
+
+// ErrTokenRevoked is returned by VerifyClaim for tokens no longer valid,
+// other errors mean the DB could not tell
+var ErrTokenRevoked = errors.New("token revoked")
+
+// Device is where a token or session is used from. CertThumbprint is
+// the one of the verified client certificate, tokens issued to the
+// device are bound to it
+type Device struct {
+	UserAgent      string `json:"useragent"`
+	IP             string `json:"ip"`
+	CertThumbprint string `json:"certthumbprint,omitempty"`
+}
+
+// Confirmation is the 'cnf' claim of tokens bound to the client
+// certificate they were issued to, RFC 8705
+type Confirmation struct {
+	X5tS256 string `json:"x5t#S256"`
+}
+
+// CertThumbprint - the x5t#S256 thumbprint of a DER encoded certificate:
+// its SHA-256 hash, base64url encoded without padding
+func CertThumbprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// BoundTo - check the claim can be used along with the client certificate
+// with the given thumbprint, unbound claims go along with any or none
+func (c *Claim) BoundTo(thumbprint string) bool {
+	if c.Confirmation == nil {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Confirmation.X5tS256), []byte(thumbprint)) == 1
+}
+
+// IssuedToken wraps the record of a token handed out to a user,
+// its ID is the token 'jti' claim. The token itself isn't stored
+type IssuedToken struct {
+	ID         string `json:"id"`
+	UserID     string `json:"userid"`
+	Device     Device `json:"device"`
+	CreatedAt  int64  `json:"createdat"`
+	LastUsedAt int64  `json:"lastusedat"`
+	ExpiresAt  int64  `json:"expiresat"`
+}
+
+// IssueToken - returns a new JWT for the user and records it along with
+// the device it was issued to, binding it to the device client certificate
+func (a Access) IssueToken(ctx context.Context, u User, d Device) (string, int64, error) {
+	defer observeStorage(ctx, "issue_token")()
+
+	id := newID()
+
+	ss, exp, err := a.newToken(u, id, d.CertThumbprint)
+	if err != nil {
+		return "", 0, err
+	}
+
+	now := time.Now().Unix()
+	t := IssuedToken{
+		ID:         id,
+		UserID:     u.ID,
+		Device:     d,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  exp,
+	}
+
+	if err := a.tokenc.Insert(t); err != nil {
+		return "", 0, errors.Wrap(err, "could not record token for user "+u.Email)
+	}
+	return ss, exp, nil
+}
+
+// RevokeToken - revoke the token of the user with the given ID,
+// ErrTokenRevoked is the cause when it was already revoked
+func (a Access) RevokeToken(ctx context.Context, userID, id string) error {
+	defer observeStorage(ctx, "revoke_token")()
+
+	err := a.tokenc.Remove(bson.M{"id": id, "userid": userID})
+	if err == mgo.ErrNotFound {
+		return errors.Wrapf(ErrTokenRevoked, "token %s for user %s", id, userID)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not revoke token "+id)
+	}
+	return nil
+}
+
+// touchToken - make sure the token with the given ID wasn't
+// revoked, updating its last used time
+func (a Access) touchToken(id, userID string) error {
+	sel := bson.M{"id": id, "userid": userID}
+
+	t := IssuedToken{}
+	if err := a.tokenc.Find(sel).One(&t); err != nil {
+		if err == mgo.ErrNotFound {
+			return errors.Wrapf(ErrTokenRevoked, "token %s for user %s", id, userID)
+		}
+		return errors.Wrap(err, "could not retrieve token "+id)
+	}
+
+	now := time.Now().Unix()
+	if now-t.LastUsedAt < int64(touchInterval.Seconds()) {
+		return nil
+	}
+
+	if err := a.tokenc.Update(sel, bson.M{"$set": bson.M{"lastusedat": now}}); err != nil {
+		return errors.Wrap(err, "could not touch token "+id)
+	}
+	return nil
+}
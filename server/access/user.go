@@ -0,0 +1,246 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// maxFailedLogins is how many wrong passwords in a row lock an account
+	maxFailedLogins = 5
+
+	// lockDuration is how long an account stays locked unless unlocked by an admin
+	lockDuration = 15 * time.Minute
+)
+
+// Locked - check if the account is locked at the given time
+func (u User) Locked(now time.Time) bool {
+	return u.LockedUntil > now.Unix()
+}
+
+// ListUsers - search users by name or email (case insensitive, empty query
+// matches everyone) returning the requested page and the total matches
+func (a Access) ListUsers(ctx context.Context, query string, skip, limit int) ([]User, int, error) {
+	defer observeStorage(ctx, "list_users")()
+
+	sel := bson.M{}
+	if query != "" {
+		re := bson.RegEx{Pattern: regexp.QuoteMeta(query), Options: "i"}
+		sel = bson.M{"$or": []bson.M{{"name": re}, {"email": re}}}
+	}
+
+	q := a.userc.Find(sel)
+
+	total, err := q.Count()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not count users")
+	}
+
+	users := []User{}
+	if err := q.Sort("email").Skip(skip).Limit(limit).All(&users); err != nil {
+		return nil, 0, errors.Wrap(err, "could not list users")
+	}
+	return users, total, nil
+}
+
+// SetDisabled - disable or enable a user account, disabling also revokes
+// its tokens, personal access tokens included, and ends its sessions so
+// enabling it back doesn't bring them back
+func (a Access) SetDisabled(ctx context.Context, userID string, disabled bool) error {
+	defer observeStorage(ctx, "set_disabled")()
+
+	set := bson.M{"disabled": disabled}
+	if disabled {
+		if err := a.removeCredentials(userID); err != nil {
+			return err
+		}
+		if _, err := a.patc.RemoveAll(bson.M{"userid": userID}); err != nil {
+			return errors.Wrap(err, "could not remove personal tokens for user "+userID)
+		}
+		set["tokensrevokedat"] = time.Now().Unix()
+	}
+	return a.updateUser(userID, bson.M{"$set": set}, "set disabled")
+}
+
+// RequirePasswordReset - revoke the user tokens, end their sessions
+// and refuse new ones until the user changes the password
+func (a Access) RequirePasswordReset(ctx context.Context, userID string) error {
+	defer observeStorage(ctx, "require_password_reset")()
+
+	if err := a.removeCredentials(userID); err != nil {
+		return err
+	}
+
+	set := bson.M{"passwordresetrequired": true, "tokensrevokedat": time.Now().Unix()}
+	return a.updateUser(userID, bson.M{"$set": set}, "require password reset")
+}
+
+// UpdatePassword - store a new password hash, clearing any pending
+// reset, revoking the tokens issued with the old password and ending
+// the sessions opened with it
+func (a Access) UpdatePassword(ctx context.Context, userID, passwordHash string) error {
+	defer observeStorage(ctx, "update_password")()
+
+	if err := a.removeCredentials(userID); err != nil {
+		return err
+	}
+
+	set := bson.M{
+		"passwordhash":          passwordHash,
+		"passwordresetrequired": false,
+		"tokensrevokedat":       time.Now().Unix(),
+	}
+	return a.updateUser(userID, bson.M{"$set": set}, "update password")
+}
+
+// MarkEmailVerified - record the user proved owning the email,
+// reporting whether this is the first time
+func (a Access) MarkEmailVerified(ctx context.Context, userID string) (bool, error) {
+	defer observeStorage(ctx, "mark_email_verified")()
+
+	sel := bson.M{"id": userID, "emailverifiedat": bson.M{"$in": []interface{}{nil, 0}}}
+	err := a.userc.Update(sel, bson.M{"$set": bson.M{"emailverifiedat": time.Now().Unix()}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "could not mark email verified for user "+userID)
+	}
+	return true, nil
+}
+
+// RevokeTokens - invalidate every token issued to the user so far,
+// personal access tokens included, and end their sessions
+func (a Access) RevokeTokens(ctx context.Context, userID string) error {
+	defer observeStorage(ctx, "revoke_tokens")()
+
+	if err := a.removeCredentials(userID); err != nil {
+		return err
+	}
+
+	if _, err := a.patc.RemoveAll(bson.M{"userid": userID}); err != nil {
+		return errors.Wrap(err, "could not remove personal tokens for user "+userID)
+	}
+	return a.updateUser(userID, bson.M{"$set": bson.M{"tokensrevokedat": time.Now().Unix()}}, "revoke tokens")
+}
+
+// removeCredentials - remove the records of the user tokens,
+// revoking them, and end their sessions
+func (a Access) removeCredentials(userID string) error {
+	if _, err := a.tokenc.RemoveAll(bson.M{"userid": userID}); err != nil {
+		return errors.Wrap(err, "could not remove tokens for user "+userID)
+	}
+
+	if _, err := a.sessionc.RemoveAll(bson.M{"userid": userID}); err != nil {
+		return errors.Wrap(err, "could not remove sessions for user "+userID)
+	}
+	return nil
+}
+
+// Unlock - clear failed logins and any lock on the account
+func (a Access) Unlock(ctx context.Context, userID string) error {
+	defer observeStorage(ctx, "unlock")()
+
+	return a.updateUser(userID, bson.M{"$set": bson.M{"failedlogins": 0, "lockeduntil": 0}}, "unlock")
+}
+
+// DeleteUser - remove the user and its tokens from DB
+func (a Access) DeleteUser(ctx context.Context, userID string) error {
+	defer observeStorage(ctx, "delete_user")()
+
+	if _, err := a.tokenc.RemoveAll(bson.M{"userid": userID}); err != nil {
+		return errors.Wrap(err, "could not remove tokens for user "+userID)
+	}
+
+	if _, err := a.sessionc.RemoveAll(bson.M{"userid": userID}); err != nil {
+		return errors.Wrap(err, "could not remove sessions for user "+userID)
+	}
+
+	if _, err := a.patc.RemoveAll(bson.M{"userid": userID}); err != nil {
+		return errors.Wrap(err, "could not remove personal tokens for user "+userID)
+	}
+
+	if _, err := a.magicc.RemoveAll(bson.M{"userid": userID}); err != nil {
+		return errors.Wrap(err, "could not remove magic links for user "+userID)
+	}
+
+	if err := a.userc.Remove(bson.M{"id": userID}); err != nil {
+		return errors.Wrap(err, "could not delete user "+userID)
+	}
+	return nil
+}
+
+// RecordFailedLogin - count a wrong password for the user,
+// locking the account once maxFailedLogins is reached
+func (a Access) RecordFailedLogin(ctx context.Context, userID string) error {
+	defer observeStorage(ctx, "record_failed_login")()
+
+	u := User{}
+	change := mgo.Change{Update: bson.M{"$inc": bson.M{"failedlogins": 1}}, ReturnNew: true}
+	if _, err := a.userc.Find(bson.M{"id": userID}).Apply(change, &u); err != nil {
+		return errors.Wrap(err, "could not record failed login for user "+userID)
+	}
+
+	if u.FailedLogins < maxFailedLogins {
+		return nil
+	}
+
+	lock := bson.M{"failedlogins": 0, "lockeduntil": time.Now().Add(lockDuration).Unix()}
+	return a.updateUser(userID, bson.M{"$set": lock}, "lock")
+}
+
+// ResetFailedLogins - forget previous wrong passwords after a successful login
+func (a Access) ResetFailedLogins(ctx context.Context, userID string) error {
+	defer observeStorage(ctx, "reset_failed_logins")()
+
+	return a.updateUser(userID, bson.M{"$set": bson.M{"failedlogins": 0}}, "reset failed logins")
+}
+
+// VerifyClaim - check against DB that the token owner still exists,
+// is enabled and did not have the token revoked. Those checks failing
+// return ErrTokenRevoked as the cause. The roles and permissions of c
+// are narrowed to the ones the owner still has
+func (a Access) VerifyClaim(ctx context.Context, c *Claim) error {
+	defer observeStorage(ctx, "verify_claim")()
+
+	u, err := a.FindUserByID(ctx, c.Subject)
+	if errors.Cause(err) == mgo.ErrNotFound {
+		return errors.Wrapf(ErrTokenRevoked, "user %s not found", c.Subject)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not find token owner")
+	}
+
+	if u.Disabled {
+		return errors.Wrapf(ErrTokenRevoked, "user %s is disabled", u.ID)
+	}
+
+	c.restrictTo(u)
+
+	// tokens with IDs are revoked by removing their record
+	if c.Id != "" {
+		return a.touchToken(c.Id, u.ID)
+	}
+
+	// tokens issued before they had IDs can only be revoked all at once.
+	// revocation has second precision, so tokens issued in the same
+	// second of a revocation are revoked too
+	if c.IssuedAt <= u.TokensRevokedAt {
+		return errors.Wrapf(ErrTokenRevoked, "token issued at %d for user %s was revoked at %d",
+			c.IssuedAt, u.ID, u.TokensRevokedAt)
+	}
+	return nil
+}
+
+func (a Access) updateUser(userID string, change bson.M, op string) error {
+	if err := a.userc.Update(bson.M{"id": userID}, change); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not %s user %s", op, userID))
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package access
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// user lifecycle events sent to webhook subscriptions
+const (
+	WebhookUserCreated     = "user.created"
+	WebhookUserVerified    = "user.verified"
+	WebhookUserDeleted     = "user.deleted"
+	WebhookTokenIssued     = "token.issued"
+	WebhookPasswordChanged = "password.changed"
+)
+
+// webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// webhookEvents lists the events subscriptions can ask for
+var webhookEvents = []string{
+	WebhookUserCreated,
+	WebhookUserVerified,
+	WebhookUserDeleted,
+	WebhookTokenIssued,
+	WebhookPasswordChanged,
+}
+
+// Subscription is a webhook from the configuration file: the events
+// POSTed to URL, signed with Secret
+type Subscription struct {
+	Name   string   `mapstructure:"name"`
+	URL    string   `mapstructure:"url"`
+	Secret string   `mapstructure:"secret"`
+	Events []string `mapstructure:"events"`
+}
+
+// wants - check if the subscription asked for the event
+func (s Subscription) wants(event string) bool {
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body POSTed to subscriptions
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt int64       `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// UserData is the data of user events
+type UserData struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+}
+
+// NewUserData - the data of user events about u
+func NewUserData(u User) UserData {
+	return UserData{u.ID, u.Name, u.Email}
+}
+
+// TokenIssuedData is the data of token.issued events, the token itself is never sent
+type TokenIssuedData struct {
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// Delivery is a webhook payload queued for a subscription, along
+// with how sending it went so far
+type Delivery struct {
+	ID            string `json:"id"`
+	Subscription  string `json:"subscription"`
+	Event         string `json:"event"`
+	Payload       string `json:"payload"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt int64  `json:"nextattemptat"`
+	LastStatus    int    `json:"laststatus,omitempty"`
+	LastError     string `json:"lasterror,omitempty"`
+	CreatedAt     int64  `json:"createdat"`
+	DeliveredAt   int64  `json:"deliveredat,omitempty"`
+}
+
+// validateSubscriptions - return an error for subscriptions missing
+// a name, URL or secret, with repeated names or unknown events
+func validateSubscriptions(subs []Subscription) error {
+	names := map[string]bool{}
+	for _, s := range subs {
+		if s.Name == "" || s.URL == "" || s.Secret == "" {
+			return fmt.Errorf("webhook '%s' needs a name, url and secret", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("webhook name '%s' is repeated", s.Name)
+		}
+		names[s.Name] = true
+
+		for _, e := range s.Events {
+			if !knownWebhookEvent(e) {
+				return fmt.Errorf("webhook '%s' has unknown event '%s'", s.Name, e)
+			}
+		}
+	}
+	return nil
+}
+
+func knownWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// QueueWebhook - queue a delivery of the event with data for
+// every subscription asking for it. Nothing is stored when
+// no subscription does
+func (a Access) QueueWebhook(ctx context.Context, event string, data interface{}) error {
+	defer observeStorage(ctx, "queue_webhook")()
+
+	now := time.Now().Unix()
+	for _, s := range a.Webhooks {
+		if !s.wants(event) {
+			continue
+		}
+
+		id := newID()
+		b, err := json.Marshal(WebhookPayload{id, event, now, data})
+		if err != nil {
+			return errors.Wrap(err, "could not encode webhook payload for "+event)
+		}
+
+		d := Delivery{
+			ID:            id,
+			Subscription:  s.Name,
+			Event:         event,
+			Payload:       string(b),
+			Status:        DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+
+		if err := a.webhookc.Insert(d); err != nil {
+			return errors.Wrap(err, "could not queue webhook "+event+" for "+s.Name)
+		}
+	}
+	return nil
+}
+
+// ClaimDelivery - take the next pending delivery due by now, keeping
+// other servers off it until lease passes. The claim counts as an
+// attempt. Returns mgo.ErrNotFound when nothing is due
+func (a Access) ClaimDelivery(ctx context.Context, now time.Time, lease time.Duration) (Delivery, error) {
+	defer observeStorage(ctx, "claim_delivery")()
+
+	sel := bson.M{"status": DeliveryPending, "nextattemptat": bson.M{"$lte": now.Unix()}}
+	change := mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"nextattemptat": now.Add(lease).Unix()},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}
+
+	d := Delivery{}
+	if _, err := a.webhookc.Find(sel).Sort("nextattemptat").Apply(change, &d); err != nil {
+		if err == mgo.ErrNotFound {
+			return Delivery{}, err
+		}
+		return Delivery{}, errors.Wrap(err, "could not claim webhook delivery")
+	}
+	return d, nil
+}
+
+// DeliveryDone - record how the last attempt of the delivery went.
+// A zero retryAt marks it delivered when err is nil and failed for
+// good otherwise, else it is attempted again at retryAt
+func (a Access) DeliveryDone(ctx context.Context, id string, status int, err error, retryAt time.Time) error {
+	defer observeStorage(ctx, "delivery_done")()
+
+	set := bson.M{"laststatus": status, "lasterror": ""}
+	switch {
+	case err == nil:
+		set["status"] = DeliveryDelivered
+		set["deliveredat"] = time.Now().Unix()
+	case retryAt.IsZero():
+		set["status"] = DeliveryFailed
+		set["lasterror"] = err.Error()
+	default:
+		set["nextattemptat"] = retryAt.Unix()
+		set["lasterror"] = err.Error()
+	}
+
+	if err := a.webhookc.Update(bson.M{"id": id}, bson.M{"$set": set}); err != nil {
+		return errors.Wrap(err, "could not update webhook delivery "+id)
+	}
+	return nil
+}
+
+// RetryDelivery - queue a failed delivery again, with fresh attempts
+func (a Access) RetryDelivery(ctx context.Context, id string) error {
+	defer observeStorage(ctx, "retry_delivery")()
+
+	sel := bson.M{"id": id, "status": DeliveryFailed}
+	set := bson.M{"status": DeliveryPending, "attempts": 0, "nextattemptat": time.Now().Unix()}
+	if err := a.webhookc.Update(sel, bson.M{"$set": set}); err != nil {
+		return errors.Wrap(err, "could not retry webhook delivery "+id)
+	}
+	return nil
+}
+
+// ListDeliveries - the webhook deliveries with the given status and
+// event, any when empty, newest first. Also returns how many match
+func (a Access) ListDeliveries(ctx context.Context, status, event string, skip, limit int) ([]Delivery, int, error) {
+	defer observeStorage(ctx, "list_deliveries")()
+
+	sel := bson.M{}
+	if status != "" {
+		sel["status"] = status
+	}
+	if event != "" {
+		sel["event"] = event
+	}
+
+	q := a.webhookc.Find(sel)
+	total, err := q.Count()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not count webhook deliveries")
+	}
+
+	deliveries := []Delivery{}
+	if err := q.Sort("-createdat").Skip(skip).Limit(limit).All(&deliveries); err != nil {
+		return nil, 0, errors.Wrap(err, "could not retrieve webhook deliveries")
+	}
+	return deliveries, total, nil
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// listUsersHandler search users by name or email, paginated
+// through the 'q', 'page' and 'per_page' query parameters
+func (ah *accessHandler) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	page, err := queryInt(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		logger(r.Context()).Warnf("invalid page '%s'", q.Get("page"))
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid page",
+		})
+		return
+	}
+
+	perPage, err := queryInt(q.Get("per_page"), defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		logger(r.Context()).Warnf("invalid per_page '%s'", q.Get("per_page"))
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid per_page",
+		})
+		return
+	}
+
+	users, total, err := ah.ListUsers(r.Context(), q.Get("q"), (page-1)*perPage, perPage)
+	if err != nil {
+		logger(r.Context()).Warnf("could not list users: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	resp := struct {
+		Users   []access.User `json:"users"`
+		Page    int           `json:"page"`
+		PerPage int           `json:"per_page"`
+		Total   int           `json:"total"`
+	}{
+		users,
+		page,
+		perPage,
+		total,
+	}
+	renderJSON(w, http.StatusOK, resp)
+}
+
+// getUserHandler render the details of a single user
+func (ah *accessHandler) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	u, err := ah.FindUserByID(r.Context(), id)
+	if err != nil {
+		logger(r.Context()).Warnf("could not find user %s: %s", id, err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusNotFound,
+			Description: "Not Found",
+		})
+		return
+	}
+	renderJSON(w, http.StatusOK, u)
+}
+
+// putUserRolesHandler replace the roles and permissions of a user
+func (ah *accessHandler) putUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Roles       []string `json:"roles"`
+		Permissions []string `json:"permissions"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger(r.Context()).Warnf("could not decode roles request body: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid json body",
+		})
+		return
+	}
+
+	if err := access.ValidateRoles(body.Roles); err != nil {
+		logger(r.Context()).Warnf("could not validate roles: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid roles",
+		})
+		return
+	}
+
+	if err := access.ValidatePermissions(body.Permissions); err != nil {
+		logger(r.Context()).Warnf("could not validate permissions: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid permissions",
+		})
+		return
+	}
+
+	ah.userActionHandler(access.AuditUserRoles, func(ctx context.Context, id string) error {
+		return ah.SetRoles(ctx, id, body.Roles, body.Permissions)
+	})(w, r)
+}
+
+// userActionHandler builds a handler applying action to the user in the
+// URL, recording it in the audit trail and rendering the updated user
+func (ah *accessHandler) userActionHandler(action string, apply func(ctx context.Context, id string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+		target, err := ah.FindUserByID(r.Context(), id)
+		if err != nil {
+			logger(r.Context()).Warnf("could not find user %s: %s", id, err)
+			renderJSONError(w, responseError{
+				Code:        http.StatusNotFound,
+				Description: "Not Found",
+			})
+			return
+		}
+
+		if err := apply(r.Context(), id); err != nil {
+			logger(r.Context()).Warnf("could not apply %s to user %s: %s", action, id, err)
+			renderJSONError(w, responseError{
+				Code:        http.StatusInternalServerError,
+				Description: "Internal Server Error",
+			})
+			return
+		}
+
+		actor := claimFromContext(r.Context()).Subject
+		ah.audit(r.Context(), access.AuditEvent{Action: action, Actor: actor, Target: id}, ah.device(r))
+
+		logger(r.Context()).Infof("%s applied to user %s by %s", action, id, actor)
+
+		if action == access.AuditUserDelete {
+			ah.notify(r.Context(), access.WebhookUserDeleted, access.NewUserData(target))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		u, err := ah.FindUserByID(r.Context(), id)
+		if err != nil {
+			logger(r.Context()).Warnf("could not find user %s: %s", id, err)
+			renderJSONError(w, responseError{
+				Code:        http.StatusInternalServerError,
+				Description: "Internal Server Error",
+			})
+			return
+		}
+		renderJSON(w, http.StatusOK, u)
+	}
+}
+
+// queryInt parse an integer query parameter, falling back to def when empty
+func queryInt(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/betalotest/auth/server/access"
+)
+
+func TestAdminRoutesRequireAdmin(t *testing.T) {
+	tt := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/admin/users"},
+		{"GET", "/admin/users/4f1c6b1e"},
+		{"DELETE", "/admin/users/4f1c6b1e"},
+		{"POST", "/admin/users/4f1c6b1e/disable"},
+		{"POST", "/admin/users/4f1c6b1e/enable"},
+		{"POST", "/admin/users/4f1c6b1e/reset-password"},
+		{"POST", "/admin/users/4f1c6b1e/revoke-tokens"},
+		{"POST", "/admin/users/4f1c6b1e/unlock"},
+		{"PUT", "/admin/users/4f1c6b1e/roles"},
+		{"GET", "/admin/audit"},
+		{"GET", "/admin/invites"},
+		{"POST", "/admin/invites"},
+		{"DELETE", "/admin/invites/9b2e7c4a"},
+		{"GET", "/admin/webhooks/deliveries"},
+		{"POST", "/admin/webhooks/deliveries/9b2e7c4a/retry"},
+	}
+
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			for auth, statusCode := range map[string]int{
+				"": 401,
+				"Bearer " + newTestToken(t, access.RoleUser): 403,
+			} {
+				req, err := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+				if err != nil {
+					t.Fatalf("could not create request: %s", err)
+				}
+				if auth != "" {
+					req.Header.Set("Authorization", auth)
+				}
+
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("could not execute request: %s", err)
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != statusCode {
+					t.Errorf("expected status code %d; got %d", statusCode, resp.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryInt(t *testing.T) {
+	tt := []struct {
+		label string
+		value string
+		def   int
+		n     int
+		err   bool
+	}{
+		{"empty", "", 20, 20, false},
+		{"number", "3", 20, 3, false},
+		{"not a number", "xablau", 20, 0, true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			n, err := queryInt(tc.value, tc.def)
+			if (err != nil) != tc.err {
+				t.Errorf("expected error to be %t; got '%v'", tc.err, err)
+			}
+			if n != tc.n {
+				t.Errorf("expected %d; got %d", tc.n, n)
+			}
+		})
+	}
+}
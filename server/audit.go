@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/betalotest/auth/server/access"
+)
+
+// jsonLines is the media type of audit exports, one event per line
+const jsonLines = "application/x-ndjson"
+
+// audit records the security event e coming from the device d.
+// Failing to record it is logged, the request goes on regardless
+func (ah *accessHandler) audit(ctx context.Context, e access.AuditEvent, d access.Device) {
+	e.IP, e.UserAgent = d.IP, d.UserAgent
+	if err := ah.RecordAudit(ctx, e); err != nil {
+		logger(ctx).Errorf("could not audit %s of %s by %s: %s", e.Action, e.Target, e.Actor, err)
+	}
+}
+
+// getAuditHandler search the audit trail by the 'action', 'actor',
+// 'target', 'since' and 'until' query parameters. Results are paginated
+// like listUsersHandler, or the whole match is exported as JSON lines
+// with 'format=jsonl' or when the client accepts application/x-ndjson
+func (ah *accessHandler) getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	since, err := queryInt(q.Get("since"), 0)
+	if err != nil || since < 0 {
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid since",
+		})
+		return
+	}
+
+	until, err := queryInt(q.Get("until"), 0)
+	if err != nil || until < 0 {
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid until",
+		})
+		return
+	}
+
+	f := access.AuditFilter{
+		Action: q.Get("action"),
+		Actor:  q.Get("actor"),
+		Target: q.Get("target"),
+		Since:  int64(since),
+		Until:  int64(until),
+	}
+
+	if q.Get("format") == "jsonl" || r.Header.Get("Accept") == jsonLines {
+		ah.exportAudit(r.Context(), w, f)
+		return
+	}
+
+	page, err := queryInt(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid page",
+		})
+		return
+	}
+
+	perPage, err := queryInt(q.Get("per_page"), defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid per_page",
+		})
+		return
+	}
+
+	events, total, err := ah.ListAudit(r.Context(), f, (page-1)*perPage, perPage)
+	if err != nil {
+		logger(r.Context()).Warnf("could not list audit events: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	resp := struct {
+		Events  []access.AuditEvent `json:"events"`
+		Page    int                 `json:"page"`
+		PerPage int                 `json:"per_page"`
+		Total   int                 `json:"total"`
+	}{
+		events,
+		page,
+		perPage,
+		total,
+	}
+	renderJSON(w, http.StatusOK, resp)
+}
+
+// exportAudit streams the events matching f as JSON lines, oldest first
+func (ah *accessHandler) exportAudit(ctx context.Context, w http.ResponseWriter, f access.AuditFilter) {
+	w.Header().Set("Content-Type", jsonLines)
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+
+	enc := json.NewEncoder(w)
+	started := false
+	err := ah.ExportAudit(ctx, f, func(e access.AuditEvent) error {
+		started = true
+		return enc.Encode(e)
+	})
+	if err == nil {
+		return
+	}
+
+	logger(ctx).Warnf("could not export audit events: %s", err)
+
+	// once lines are out the status is sent, the export is just cut short
+	if !started {
+		renderJSONError(w, responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetAuditHandler(t *testing.T) {
+	tt := []struct {
+		label string
+		query string
+		cause string
+	}{
+		{"invalid since", "since=yesterday", "invalid since"},
+		{"negative until", "until=-1", "invalid until"},
+		{"invalid page", "page=0", "invalid page"},
+		{"invalid per_page", "per_page=1000", "invalid per_page"},
+	}
+
+	ah := &accessHandler{acc, &tmplHandler{tmpl}, conf}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ah.getAuditHandler(w, httptest.NewRequest("GET", "/admin/audit?"+tc.query, nil))
+
+			if w.Code != 400 {
+				t.Errorf("expected status code 400; got %d", w.Code)
+			}
+
+			if !strings.Contains(w.Body.String(), tc.cause) {
+				t.Errorf("expected response to have cause %s; got %s", tc.cause, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/pkg/errors"
+)
+
+type contextKey string
+
+// claimKey is the request context key holding the bearer token claims
+const claimKey contextKey = "claim"
+
+// requireToken guards h so it only runs for requests with a valid
+// bearer token. The token claims are available to h through claimFromContext
+func (ah *accessHandler) requireToken(h http.HandlerFunc) http.HandlerFunc {
+	return ah.requirePermission("", h)
+}
+
+// requirePermission guards h so it only runs for requests with a valid
+// bearer token granting perm, any valid token will do if perm is empty.
+// The token claims are available to h through claimFromContext
+func (ah *accessHandler) requirePermission(perm string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, rerr := ah.verifyToken(r.Context(), bearerToken(r), perm)
+		if rerr == nil {
+			rerr = checkBinding(r.Context(), c, ah.device(r))
+		}
+		if rerr != nil {
+			switch {
+			case rerr.Code != http.StatusUnauthorized:
+			case bearerToken(r) == "":
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			default:
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			}
+			renderJSONError(w, *rerr)
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), claimKey, c)))
+	}
+}
+
+// requireLogin guards h so it only runs for requests with a valid bearer
+// token or browser session. Browser sessions get the claims a token of
+// their owner would have, either way the claim ID is the one of the token
+// or session in use. Browsers without a session are sent to the login form
+func (ah *accessHandler) requireLogin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := r.Cookie(sessionCookie)
+		switch {
+		case bearerToken(r) != "" || err != nil && wantsJSON(r):
+			ah.requireToken(h)(w, r)
+			return
+		case err != nil:
+			http.Redirect(w, r, "/token", http.StatusSeeOther)
+			return
+		}
+
+		u, s, rerr := ah.sessionUser(r)
+		if rerr != nil {
+			renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+			return
+		}
+
+		c := &access.Claim{
+			User:        u.Name,
+			Email:       u.Email,
+			Roles:       u.EffectiveRoles(),
+			Permissions: u.EffectivePermissions(),
+		}
+		c.Subject = u.ID
+		c.Id = s.ID
+		h(w, r.WithContext(context.WithValue(r.Context(), claimKey, c)))
+	}
+}
+
+// verifyToken checks that ss is a valid, not revoked, JWT or personal
+// access token granting perm, any valid token will do if perm is empty
+func (ah *accessHandler) verifyToken(ctx context.Context, ss, perm string) (*access.Claim, *responseError) {
+	if ss == "" {
+		return nil, &responseError{
+			Code:        http.StatusUnauthorized,
+			Description: "Unauthorized",
+			Cause:       "missing bearer token",
+		}
+	}
+
+	// personal tokens live in the db, there is nothing to check before
+	if access.IsPersonalToken(ss) {
+		c, err := ah.VerifyPersonalToken(ctx, ss)
+		if errors.Cause(err) == access.ErrTokenRevoked {
+			logger(ctx).Warnf("could not verify personal token: %s", err)
+			return nil, &responseError{
+				Code:        http.StatusUnauthorized,
+				Description: "Unauthorized",
+				Cause:       "invalid token",
+			}
+		}
+		if err != nil {
+			return nil, claimError(ctx, err)
+		}
+		if rerr := missingPermission(ctx, c, perm); rerr != nil {
+			return nil, rerr
+		}
+		return c, nil
+	}
+
+	c, err := ah.ParseToken(ss)
+	if err != nil {
+		logger(ctx).Warnf("could not parse bearer token: %s", err)
+		return nil, &responseError{
+			Code:        http.StatusUnauthorized,
+			Description: "Unauthorized",
+			Cause:       "invalid token",
+		}
+	}
+
+	if rerr := missingPermission(ctx, c, perm); rerr != nil {
+		return nil, rerr
+	}
+
+	// only hit the db once the token itself is known to be good enough
+	if err := ah.VerifyClaim(ctx, c); err != nil {
+		return nil, claimError(ctx, err)
+	}
+
+	// the owner may have lost perm since the token was issued
+	if rerr := missingPermission(ctx, c, perm); rerr != nil {
+		return nil, rerr
+	}
+	return c, nil
+}
+
+// claimError returns the error for claims VerifyClaim failed, a storage
+// error must not pass for a revoked token nor a revoked token for an outage
+func claimError(ctx context.Context, err error) *responseError {
+	if errors.Cause(err) != access.ErrTokenRevoked {
+		logger(ctx).Errorf("could not verify claim: %s", err)
+		return &responseError{
+			Code:        http.StatusServiceUnavailable,
+			Description: "Service Unavailable",
+		}
+	}
+
+	logger(ctx).Warnf("could not verify claim: %s", err)
+	return &responseError{
+		Code:        http.StatusUnauthorized,
+		Description: "Unauthorized",
+		Cause:       "revoked token",
+	}
+}
+
+// checkBinding returns the error for claims bound to a client
+// certificate other than the one of the device using them
+func checkBinding(ctx context.Context, c *access.Claim, d access.Device) *responseError {
+	if c.BoundTo(d.CertThumbprint) {
+		return nil
+	}
+
+	logger(ctx).Warnf("token of user %s used without the certificate it is bound to", c.Subject)
+	return &responseError{
+		Code:        http.StatusUnauthorized,
+		Description: "Unauthorized",
+		Cause:       "certificate mismatch",
+	}
+}
+
+// missingPermission returns the error for claims not granting perm
+func missingPermission(ctx context.Context, c *access.Claim, perm string) *responseError {
+	if perm == "" || c.HasPermission(perm) {
+		return nil
+	}
+
+	logger(ctx).Warnf("user %s lacks permission %s", c.Subject, perm)
+	return &responseError{
+		Code:        http.StatusForbidden,
+		Description: "Forbidden",
+		Cause:       "missing permission " + perm,
+	}
+}
+
+// claimFromContext returns the claims stored by requirePermission or requireLogin
+func claimFromContext(ctx context.Context) *access.Claim {
+	c, _ := ctx.Value(claimKey).(*access.Claim)
+	return c
+}
+
+// bearerToken extracts the token from the Authorization header
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
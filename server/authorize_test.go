@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/pkg/errors"
+)
+
+func TestRequirePermission(t *testing.T) {
+	tt := []struct {
+		label      string
+		auth       string
+		body       string
+		cause      string
+		statusCode int
+	}{
+		{"missing token", "", "{}", "missing bearer token", 401},
+		{"malformed header", "Basic Zm9vOmJhcg==", "{}", "missing bearer token", 401},
+		{"invalid token", "Bearer xablau", "{}", "invalid token", 401},
+		{"missing permission", "Bearer " + newTestToken(t, access.RoleUser), "{}", "missing permission roles:write", 403},
+	}
+
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req, err := http.NewRequest("PUT", srv.URL+"/admin/users/4f1c6b1e/roles", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("could not create put request: %s", err)
+			}
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute put request: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+
+			var b bytes.Buffer
+			if _, err := io.Copy(&b, resp.Body); err != nil {
+				t.Errorf("failed to copy response body: %s", err)
+			}
+
+			if !strings.Contains(b.String(), tc.cause) {
+				t.Errorf("expected error message to have cause %s; got %s",
+					tc.cause, b.String())
+			}
+		})
+	}
+}
+
+// newTestToken signs a token with acc for a user with the given roles
+func newTestToken(t *testing.T, roles ...string) string {
+	ss, _, err := acc.NewToken(access.User{ID: "4f1c6b1e", Email: "gopher@foomail.com", Roles: roles}, "9b2e7c4a")
+	if err != nil {
+		t.Fatalf("could not create token: %s", err)
+	}
+	return ss
+}
+
+func TestClaimError(t *testing.T) {
+	tt := []struct {
+		label string
+		err   error
+		code  int
+		cause string
+	}{
+		{"revoked", errors.Wrap(access.ErrTokenRevoked, "token 9b2e7c4a for user 4f1c6b1e"), http.StatusUnauthorized, "revoked token"},
+		{"storage down", errors.Wrap(errors.New("no reachable servers"), "could not find token owner"), http.StatusServiceUnavailable, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			rerr := claimError(context.Background(), tc.err)
+			if rerr.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, rerr.Code)
+			}
+			if rerr.Cause != tc.cause {
+				t.Errorf("expected cause '%s'; got '%s'", tc.cause, rerr.Cause)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/betalotest/auth/client"
+	"github.com/pkg/errors"
+)
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	c := client.New(srv.URL)
+	ctx := context.Background()
+
+	cause := func(err error) string {
+		if e, ok := errors.Cause(err).(*client.Error); ok {
+			return e.Cause
+		}
+		return ""
+	}
+
+	t.Run("signup invalid username", func(t *testing.T) {
+		_, err := c.Signup(ctx, "xa", "xablau@xmail.com", "foobar321")
+		if !client.IsBadRequest(err) || cause(err) != "invalid username" {
+			t.Errorf("expected bad request 'invalid username'; got '%v'", err)
+		}
+	})
+
+	t.Run("signup invalid password", func(t *testing.T) {
+		_, err := c.Signup(ctx, "xablau", "xablau@xmail.com", "fuu")
+		if !client.IsBadRequest(err) || cause(err) != "invalid password" {
+			t.Errorf("expected bad request 'invalid password'; got '%v'", err)
+		}
+	})
+
+	t.Run("token missing password", func(t *testing.T) {
+		_, err := c.Token(ctx, "xablau@xmail.com", "")
+		if !client.IsBadRequest(err) || cause(err) != "missing form data" {
+			t.Errorf("expected bad request 'missing form data'; got '%v'", err)
+		}
+	})
+
+	t.Run("refresh invalid token", func(t *testing.T) {
+		_, err := c.Refresh(ctx, "xablau")
+		if !client.IsUnauthorized(err) || cause(err) != "invalid token" {
+			t.Errorf("expected unauthorized 'invalid token'; got '%v'", err)
+		}
+	})
+
+	t.Run("revoke missing token", func(t *testing.T) {
+		err := c.Revoke(ctx, "")
+		if !client.IsUnauthorized(err) || cause(err) != "missing bearer token" {
+			t.Errorf("expected unauthorized 'missing bearer token'; got '%v'", err)
+		}
+	})
+
+	t.Run("introspect invalid token", func(t *testing.T) {
+		i, err := c.Introspect(ctx, "xablau")
+		if err != nil {
+			t.Fatalf("could not introspect token: %s", err)
+		}
+		if i.Active {
+			t.Error("expected invalid token to be inactive")
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/betalotest/auth/server/mail"
+	"github.com/betalotest/auth/server/tracing"
+	"github.com/betalotest/auth/server/validation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// config holds the server settings from the configuration file,
+// the db and token ones belong to access
+type config struct {
+	grpcAddress string
+
+	// extAuthzAddress is where the Envoy external authorization API is
+	// served, not at all when empty. Keep it reachable by Envoy only
+	extAuthzAddress string
+
+	// settings of the HTTP server
+	httpAddress        string
+	httpReadTimeout    time.Duration
+	httpWriteTimeout   time.Duration
+	httpIdleTimeout    time.Duration
+	httpMaxHeaderBytes int
+
+	// shutdownTimeout is how long in-flight requests have to finish on shutdown
+	shutdownTimeout time.Duration
+
+	// tls, when set, makes both servers serve TLS only
+	tls *tls.Config
+
+	// tracing tells where the spans of requests go
+	tracing tracing.Config
+
+	// at most hashConcurrency password hashes run at
+	// once, with up to hashQueueDepth more waiting
+	hashConcurrency int
+	hashQueueDepth  int
+
+	// dbConnectRetry is how long to keep trying to reach the db at startup
+	dbConnectRetry time.Duration
+
+	// attributes of the session cookie, it is always HttpOnly
+	cookieSecure   bool
+	cookieSameSite http.SameSite
+
+	// trustedProxies are the reverse proxies in front of the server,
+	// only their client_ip_header and client_cert_header are believed
+	trustedProxies []*net.IPNet
+
+	// clientIPHeader, when set, is the header the reverse proxies
+	// in front of the server put the client IP in, like X-Real-IP or
+	// X-Forwarded-For
+	clientIPHeader string
+
+	// clientCertHeader, when set, is the header the reverse proxy puts
+	// the verified client certificate in, as a URL escaped PEM
+	clientCertHeader string
+
+	// clientCAs verify the certificates passed in clientCertHeader
+	clientCAs *x509.CertPool
+
+	// publicURL is where users reach the server, links in emails point to it
+	publicURL string
+	mailer    mail.Mailer
+
+	// signupMode is one of the signup modes below, signupDomains
+	// the email domains allowed to sign up in signupDomain mode
+	signupMode    string
+	signupDomains []string
+}
+
+// signup modes
+const (
+	signupOpen     = "open"
+	signupDisabled = "disabled"
+	signupInvite   = "invite"
+	signupDomain   = "domain"
+)
+
+// sameSiteModes maps the session_cookie_samesite values
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func loadConfig(filepath string) (*config, error) {
+	v := viper.New()
+	v.SetConfigFile(filepath)
+	v.SetDefault("grpc_address", ":3001")
+	v.SetDefault("http_address", ":3000")
+	v.SetDefault("http_read_timeout", "15s")
+	v.SetDefault("http_write_timeout", "30s")
+	v.SetDefault("http_idle_timeout", "2m")
+	v.SetDefault("http_max_header_bytes", 1<<16)
+	v.SetDefault("shutdown_timeout", "30s")
+	v.SetDefault("db_connect_retry", 0)
+	v.SetDefault("hash_concurrency", runtime.NumCPU())
+	v.SetDefault("hash_queue_depth", validation.DefaultHashQueueDepth)
+	v.SetDefault("session_cookie_secure", true)
+	v.SetDefault("session_cookie_samesite", "lax")
+	v.SetDefault("client_ip_header", "")
+	v.SetDefault("client_cert_header", "")
+	v.SetDefault("tls_min_version", "1.2")
+	v.SetDefault("tracing_exporter", tracing.ExporterNone)
+	v.SetDefault("tracing_otlp_endpoint", "localhost:4317")
+	v.SetDefault("tracing_otlp_insecure", false)
+	v.SetDefault("tracing_sample_ratio", 1.0)
+	v.SetDefault("public_url", "http://localhost:3000")
+	v.SetDefault("smtp_address", "")
+	v.SetDefault("signup_mode", signupOpen)
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrap(err, "could not read from config file "+filepath)
+	}
+
+	sameSite, ok := sameSiteModes[strings.ToLower(v.GetString("session_cookie_samesite"))]
+	if !ok {
+		return nil, fmt.Errorf("invalid session_cookie_samesite '%s'", v.GetString("session_cookie_samesite"))
+	}
+
+	for _, k := range []string{"http_read_timeout", "http_write_timeout", "http_idle_timeout", "shutdown_timeout"} {
+		if v.GetDuration(k) <= 0 {
+			return nil, fmt.Errorf("invalid %s '%s'", k, v.GetString(k))
+		}
+	}
+	if v.GetInt("http_max_header_bytes") <= 0 {
+		return nil, fmt.Errorf("invalid http_max_header_bytes '%s'", v.GetString("http_max_header_bytes"))
+	}
+	if v.GetInt("hash_concurrency") <= 0 {
+		return nil, fmt.Errorf("invalid hash_concurrency '%s'", v.GetString("hash_concurrency"))
+	}
+	if v.GetInt("hash_queue_depth") < 0 {
+		return nil, fmt.Errorf("invalid hash_queue_depth '%s'", v.GetString("hash_queue_depth"))
+	}
+
+	tlsConf, err := loadTLSConfig(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tls settings")
+	}
+
+	proxies, err := parseTrustedProxies(v.GetStringSlice("trusted_proxies"))
+	if err != nil {
+		return nil, err
+	}
+
+	clientCAs, err := loadClientCAs(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tls settings")
+	}
+	if v.GetString("client_ip_header") != "" && len(proxies) == 0 {
+		return nil, errors.New("client_ip_header needs trusted_proxies")
+	}
+	if v.GetString("client_cert_header") != "" && (clientCAs == nil || len(proxies) == 0) {
+		return nil, errors.New("client_cert_header needs tls_client_ca_file and trusted_proxies")
+	}
+
+	tracingConf := tracing.Config{
+		Exporter:     strings.ToLower(v.GetString("tracing_exporter")),
+		OTLPEndpoint: v.GetString("tracing_otlp_endpoint"),
+		OTLPInsecure: v.GetBool("tracing_otlp_insecure"),
+		SampleRatio:  v.GetFloat64("tracing_sample_ratio"),
+	}
+	if err := tracingConf.Validate(); err != nil {
+		return nil, err
+	}
+
+	mode := strings.ToLower(v.GetString("signup_mode"))
+	switch mode {
+	case signupOpen, signupDisabled, signupInvite, signupDomain:
+	default:
+		return nil, fmt.Errorf("invalid signup_mode '%s'", v.GetString("signup_mode"))
+	}
+
+	var domains []string
+	for _, d := range v.GetStringSlice("signup_allowed_domains") {
+		domains = append(domains, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@")))
+	}
+	if mode == signupDomain && len(domains) == 0 {
+		return nil, errors.New("signup_allowed_domains must be set for signup_mode domain")
+	}
+
+	// without an SMTP server emails, login links included, go to the log
+	var mailer mail.Mailer = mail.Log{}
+	if addr := v.GetString("smtp_address"); addr != "" {
+		if v.GetString("smtp_from") == "" {
+			return nil, errors.New("smtp_from must be set along with smtp_address")
+		}
+		mailer = mail.SMTP{
+			Address:  addr,
+			From:     v.GetString("smtp_from"),
+			Username: v.GetString("smtp_username"),
+			Password: v.GetString("smtp_password"),
+		}
+	} else {
+		log.Warn("smtp_address not set, emails will be logged instead of sent and login links are off")
+	}
+
+	return &config{
+		v.GetString("grpc_address"),
+		v.GetString("ext_authz_address"),
+		v.GetString("http_address"),
+		v.GetDuration("http_read_timeout"),
+		v.GetDuration("http_write_timeout"),
+		v.GetDuration("http_idle_timeout"),
+		v.GetInt("http_max_header_bytes"),
+		v.GetDuration("shutdown_timeout"),
+		tlsConf,
+		tracingConf,
+		v.GetInt("hash_concurrency"),
+		v.GetInt("hash_queue_depth"),
+		v.GetDuration("db_connect_retry"),
+		v.GetBool("session_cookie_secure"),
+		sameSite,
+		proxies,
+		v.GetString("client_ip_header"),
+		v.GetString("client_cert_header"),
+		clientCAs,
+		strings.TrimSuffix(v.GetString("public_url"), "/"),
+		mailer,
+		mode,
+		domains,
+	}, nil
+}
+
+// parseTrustedProxies parses the trusted_proxies entries,
+// CIDR ranges or single IPs
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted_proxies entry '%s'", e)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies entry '%s'", e)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// deliversMail tells whether emails reach their recipients, the links
+// in the ones mail.Log writes are redacted so nobody could use them
+func (c *config) deliversMail() bool {
+	switch c.mailer.(type) {
+	case nil, mail.Log:
+		return false
+	}
+	return true
+}
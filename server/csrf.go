@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	// csrfCookie holds the anti-forgery token of the browser
+	csrfCookie = "auth_csrf"
+
+	// csrfField is the form field, and csrfHeader the header,
+	// the token must be sent back in
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+
+	// csrfKey is the request context key holding the anti-forgery token
+	csrfKey contextKey = "csrf"
+)
+
+// formPage is the data of the templates holding forms,
+// Data is whatever else the template renders
+type formPage struct {
+	CSRFToken string
+	Data      interface{}
+}
+
+// csrf protects the HTML form endpoint h from cross-site request forgery.
+// Every browser gets a random token in a cookie that forms must send back,
+// which other sites can't read. API calls are exempt, see csrfExempt
+func (ah *accessHandler) csrf(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if c, err := r.Cookie(csrfCookie); err == nil {
+			token = c.Value
+		}
+
+		if token == "" {
+			var err error
+			if token, err = ah.setCSRFCookie(w); err != nil {
+				logger(r.Context()).Errorf("could not generate csrf token: %s", err)
+				renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+					Code:        http.StatusInternalServerError,
+					Description: "Internal Server Error",
+				})
+				return
+			}
+		}
+
+		if r.Method == "POST" && !csrfExempt(r) {
+			sent := r.Header.Get(csrfHeader)
+			if sent == "" {
+				sent = r.PostFormValue(csrfField)
+			}
+
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				logger(r.Context()).Warnf("invalid csrf token for %s %s", r.Method, r.URL.Path)
+				renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+					Code:        http.StatusForbidden,
+					Description: "Forbidden",
+					Cause:       "invalid csrf token",
+				})
+				return
+			}
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), csrfKey, &token)))
+	}
+}
+
+// rotateCSRF replaces the anti-forgery token of the browser,
+// so the one used before logging in can't be used after it
+func (ah *accessHandler) rotateCSRF(w http.ResponseWriter, r *http.Request) error {
+	token, err := ah.setCSRFCookie(w)
+	if err != nil {
+		return err
+	}
+
+	if t, ok := r.Context().Value(csrfKey).(*string); ok {
+		*t = token
+	}
+	return nil
+}
+
+// setCSRFCookie hands out a new anti-forgery token to the browser
+func (ah *accessHandler) setCSRFCookie(w http.ResponseWriter) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Secure:   ah.conf.cookieSecure,
+		HttpOnly: true,
+		SameSite: ah.conf.cookieSameSite,
+	})
+	return token, nil
+}
+
+// csrfExempt tells API calls apart from browser form posts. Forged
+// requests ride on the cookies of the browser, so requests carrying a
+// bearer token, which other sites can't set, or asking for JSON
+// without a session cookie have nothing to forge
+func csrfExempt(r *http.Request) bool {
+	if bearerToken(r) != "" {
+		return true
+	}
+
+	_, err := r.Cookie(sessionCookie)
+	return wantsJSON(r) && err != nil
+}
+
+// formData wraps data with the anti-forgery token of the request
+func formData(r *http.Request, data interface{}) formPage {
+	p := formPage{Data: data}
+	if t, ok := r.Context().Value(csrfKey).(*string); ok {
+		p.CSRFToken = *t
+	}
+	return p
+}
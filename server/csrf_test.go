@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFFormToken(t *testing.T) {
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
+	defer srv.Close()
+
+	for _, path := range []string{"/signup", "/token", "/password"} {
+		t.Run(path, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + path)
+			if err != nil {
+				t.Fatalf("could not execute GET request: %s", err)
+			}
+			defer resp.Body.Close()
+
+			var token string
+			for _, c := range resp.Cookies() {
+				if c.Name == csrfCookie {
+					token = c.Value
+				}
+			}
+
+			if token == "" {
+				t.Fatalf("expected the %s cookie to be set", csrfCookie)
+			}
+
+			var b bytes.Buffer
+			if _, err := io.Copy(&b, resp.Body); err != nil {
+				t.Fatalf("failed to copy response body: %s", err)
+			}
+
+			field := `name="csrf_token" value="` + token + `"`
+			if !strings.Contains(b.String(), field) {
+				t.Errorf("expected form to have %s; got %s", field, b.String())
+			}
+		})
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	tt := []struct {
+		label      string
+		path       string
+		cookie     string
+		field      string
+		header     string
+		accept     string
+		auth       string
+		session    bool
+		cause      string
+		statusCode int
+	}{
+		{"missing token", "/signup", "", "", "", "", "", false, "invalid csrf token", 403},
+		{"missing cookie", "/signup", "", "xablau", "", "", "", false, "invalid csrf token", 403},
+		{"wrong token", "/token", "xablau", "foobar", "", "", "", false, "invalid csrf token", 403},
+		{"form token", "/token", "xablau", "xablau", "", "", "", false, "missing form data", 400},
+		{"header token", "/password", "xablau", "", "xablau", "", "", false, "missing form data", 400},
+		{"logout missing token", "/logout", "", "", "", "", "", false, "invalid csrf token", 403},
+		{"json api", "/signup", "", "", "", "application/json", "", false, "missing form data", 400},
+		{"json with session", "/logout", "", "", "", "application/json", "", true, "invalid csrf token", 403},
+		{"bearer api", "/token", "", "", "", "", "Bearer xablau", false, "missing form data", 400},
+	}
+
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			form := url.Values{}
+			if tc.field != "" {
+				form.Add(csrfField, tc.field)
+			}
+
+			req, err := http.NewRequest("POST", srv.URL+tc.path, strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatalf("could not create post request: %s", err)
+			}
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+			if tc.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: csrfCookie, Value: tc.cookie})
+			}
+			if tc.session {
+				req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "xablau"})
+			}
+			if tc.header != "" {
+				req.Header.Set(csrfHeader, tc.header)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute post request: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+
+			var b bytes.Buffer
+			if _, err := io.Copy(&b, resp.Body); err != nil {
+				t.Fatalf("failed to copy response body: %s", err)
+			}
+
+			if !strings.Contains(b.String(), tc.cause) {
+				t.Errorf("expected response to have cause %s; got %s", tc.cause, b.String())
+			}
+		})
+	}
+}
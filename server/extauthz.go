@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/betalotest/auth/server/access"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+// extAuthzServer implements the Envoy external authorization API,
+// checking the bearer token of the requests Envoy proxies the same
+// way /auth/verify does
+type extAuthzServer struct {
+	ah *accessHandler
+}
+
+// Check allows requests carrying a valid token, passing the identity
+// headers upstream, and denies the rest with the reason in the body
+func (s *extAuthzServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	// envoy lowercases the header names
+	headers := req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+
+	c, rerr := s.ah.verifyToken(ctx, bearerFromHeader(headers["authorization"]), "")
+	if rerr == nil {
+		rerr = checkBinding(ctx, c, extAuthzDevice(req))
+	}
+	if rerr != nil {
+		return deniedResponse(rerr), nil
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{
+				// overwritten so clients can't forge them
+				Headers: []*corev3.HeaderValueOption{
+					overwriteHeader("X-Auth-User", c.Subject),
+					overwriteHeader("X-Auth-Email", c.Email),
+					overwriteHeader("X-Auth-Roles", strings.Join(c.Roles, ",")),
+				},
+			},
+		},
+	}, nil
+}
+
+// extAuthzDevice describes the client of the request Envoy checks,
+// its certificate being the one Envoy verified when using mTLS
+func extAuthzDevice(req *authv3.CheckRequest) access.Device {
+	d := access.Device{UserAgent: req.GetAttributes().GetRequest().GetHttp().GetHeaders()["user-agent"]}
+
+	source := req.GetAttributes().GetSource()
+	if cert := parseEscapedCert(source.GetCertificate()); cert != nil {
+		d.CertThumbprint = access.CertThumbprint(cert.Raw)
+	}
+	if addr := source.GetAddress().GetSocketAddress(); addr != nil {
+		d.IP = addr.GetAddress()
+	}
+	return d
+}
+
+// deniedResponse answers the client with the JSON error the HTTP handlers render
+func deniedResponse(rerr *responseError) *authv3.CheckResponse {
+	code, ok := grpcCodes[rerr.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+
+	body, _ := json.Marshal(rerr)
+
+	headers := []*corev3.HeaderValueOption{overwriteHeader("Content-Type", "application/json")}
+	if rerr.Code == http.StatusUnauthorized {
+		headers = append(headers, overwriteHeader("WWW-Authenticate", "Bearer"))
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code), Message: rerr.Cause},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				// envoy status codes are the HTTP ones
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(rerr.Code)},
+				Headers: headers,
+				Body:    string(body),
+			},
+		},
+	}
+}
+
+func overwriteHeader(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header:       &corev3.HeaderValue{Key: key, Value: value},
+		AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+}
+
+// bearerFromHeader extracts the token from an Authorization header value
+func bearerFromHeader(h string) string {
+	if len(h) >= 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestExtAuthzCheck(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	srv := extAuthzEngine(acc, conf)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("could not dial grpc server: %s", err)
+	}
+	defer conn.Close()
+
+	c := authv3.NewAuthorizationClient(conn)
+
+	tt := []struct {
+		label string
+		auth  string
+		cause string
+	}{
+		{"missing token", "", "missing bearer token"},
+		{"invalid token", "Bearer xablau", "invalid token"},
+		{"basic auth", "Basic Zm9vOmJhcg==", "missing bearer token"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			headers := map[string]string{}
+			if tc.auth != "" {
+				headers["authorization"] = tc.auth
+			}
+
+			resp, err := c.Check(context.Background(), &authv3.CheckRequest{
+				Attributes: &authv3.AttributeContext{
+					Request: &authv3.AttributeContext_Request{
+						Http: &authv3.AttributeContext_HttpRequest{
+							Method:  "GET",
+							Path:    "/xablau",
+							Headers: headers,
+						},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("could not check request: %s", err)
+			}
+
+			if codes.Code(resp.Status.Code) != codes.Unauthenticated {
+				t.Errorf("expected status %s; got %s", codes.Unauthenticated, codes.Code(resp.Status.Code))
+			}
+
+			denied := resp.GetDeniedResponse()
+			if denied == nil {
+				t.Fatal("expected denied response")
+			}
+
+			if denied.Status.Code != 401 {
+				t.Errorf("expected http status 401; got %d", denied.Status.Code)
+			}
+
+			var rerr responseError
+			if err := json.Unmarshal([]byte(denied.Body), &rerr); err != nil {
+				t.Fatalf("could not decode body: %s", err)
+			}
+			if rerr.Cause != tc.cause {
+				t.Errorf("expected cause '%s'; got '%s'", tc.cause, rerr.Cause)
+			}
+		})
+	}
+}
+
+func TestExtAuthzNotPublic(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	srv := grpcEngine(acc, conf)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("could not dial grpc server: %s", err)
+	}
+	defer conn.Close()
+
+	// Check trusts the client certificate in the request
+	_, err = authv3.NewAuthorizationClient(conn).Check(context.Background(), &authv3.CheckRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected public grpc server to not serve Check; got %v", err)
+	}
+}
+
+func TestBearerFromHeader(t *testing.T) {
+	tt := []struct {
+		label  string
+		header string
+		token  string
+	}{
+		{"bearer", "Bearer xablau", "xablau"},
+		{"lowercase", "bearer xablau", "xablau"},
+		{"basic", "Basic xablau", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if token := bearerFromHeader(tc.header); token != tc.token {
+				t.Errorf("expected token '%s'; got '%s'", tc.token, token)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"html"
+	"net"
+	"net/http"
+
+	"github.com/betalotest/auth/authpb"
+	"github.com/betalotest/auth/server/access"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcCodes maps the HTTP status of the errors
+// shared with the handlers to gRPC status codes
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusInternalServerError: codes.Internal,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+// grpcServer implements authpb.AuthServer on top
+// of the same flows the HTTP handlers use
+type grpcServer struct {
+	authpb.UnimplementedAuthServer
+	ah *accessHandler
+}
+
+func grpcEngine(a *access.Access, conf *config) *grpc.Server {
+	s := grpc.NewServer(grpcOptions(conf)...)
+	authpb.RegisterAuthServer(s, &grpcServer{ah: &accessHandler{a, nil, conf}})
+	return s
+}
+
+// extAuthzEngine serves the Envoy external authorization API apart from
+// the public gRPC API, Check trusting the client certificate in the
+// request means only Envoy should reach it
+func extAuthzEngine(a *access.Access, conf *config) *grpc.Server {
+	s := grpc.NewServer(grpcOptions(conf)...)
+	authv3.RegisterAuthorizationServer(s, &extAuthzServer{ah: &accessHandler{a, nil, conf}})
+	return s
+}
+
+func grpcOptions(conf *config) []grpc.ServerOption {
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(instrumentUnary)}
+	if conf.tls != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(conf.tls)))
+	}
+	return opts
+}
+
+// Signup registers a new user
+func (s *grpcServer) Signup(ctx context.Context, req *authpb.SignupRequest) (*authpb.SignupResponse, error) {
+	if req.Username == "" || req.Email == "" || req.Password == "" || req.PasswordCheck == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing form data")
+	}
+
+	// escaped like the form values, so users can log in either way
+	u, rerr := s.ah.register(ctx,
+		html.EscapeString(req.Username),
+		html.EscapeString(req.Email),
+		html.EscapeString(req.Password),
+		html.EscapeString(req.PasswordCheck),
+		req.InviteCode,
+		grpcDevice(ctx),
+	)
+	if rerr != nil {
+		return nil, grpcError(rerr)
+	}
+	return &authpb.SignupResponse{Id: u.ID}, nil
+}
+
+// IssueToken trades a user email and password for a token
+func (s *grpcServer) IssueToken(ctx context.Context, req *authpb.IssueTokenRequest) (*authpb.TokenResponse, error) {
+	if req.Email == "" || req.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing form data")
+	}
+
+	d := grpcDevice(ctx)
+
+	u, rerr := s.ah.authenticate(ctx, html.EscapeString(req.Email), html.EscapeString(req.Password), d)
+	if rerr != nil {
+		return nil, grpcError(rerr)
+	}
+
+	t, rerr := s.ah.issueToken(ctx, u, d)
+	if rerr != nil {
+		return nil, grpcError(rerr)
+	}
+
+	s.ah.audit(ctx, access.AuditEvent{Action: access.AuditLoginSuccess, Actor: u.ID, Target: u.ID, Detail: "password"}, d)
+	return &authpb.TokenResponse{Token: t.Token, ExpiresAt: t.ExpirationDate}, nil
+}
+
+// RefreshToken trades a valid token for a new one
+func (s *grpcServer) RefreshToken(ctx context.Context, req *authpb.RefreshTokenRequest) (*authpb.TokenResponse, error) {
+	if rerr := rejectPersonalToken(req.Token); rerr != nil {
+		return nil, grpcError(rerr)
+	}
+
+	d := grpcDevice(ctx)
+
+	c, rerr := s.ah.verifyToken(ctx, req.Token, "")
+	if rerr == nil {
+		rerr = checkBinding(ctx, c, d)
+	}
+	if rerr != nil {
+		return nil, grpcError(rerr)
+	}
+
+	t, rerr := s.ah.refreshToken(ctx, c, d)
+	if rerr != nil {
+		return nil, grpcError(rerr)
+	}
+	return &authpb.TokenResponse{Token: t.Token, ExpiresAt: t.ExpirationDate}, nil
+}
+
+// RevokeToken revokes the token, the other tokens of its owner stay valid
+func (s *grpcServer) RevokeToken(ctx context.Context, req *authpb.RevokeTokenRequest) (*authpb.RevokeTokenResponse, error) {
+	if rerr := rejectPersonalToken(req.Token); rerr != nil {
+		return nil, grpcError(rerr)
+	}
+
+	d := grpcDevice(ctx)
+
+	c, rerr := s.ah.verifyToken(ctx, req.Token, "")
+	if rerr == nil {
+		rerr = checkBinding(ctx, c, d)
+	}
+	if rerr != nil {
+		return nil, grpcError(rerr)
+	}
+
+	if rerr := s.ah.revokeToken(ctx, c, d); rerr != nil {
+		return nil, grpcError(rerr)
+	}
+	return &authpb.RevokeTokenResponse{}, nil
+}
+
+// Introspect tells whether a token is active and its claims
+func (s *grpcServer) Introspect(ctx context.Context, req *authpb.IntrospectRequest) (*authpb.IntrospectResponse, error) {
+	if req.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing form data")
+	}
+
+	c, ok, rerr := s.ah.introspect(ctx, req.Token)
+	if rerr != nil {
+		return nil, grpcError(rerr)
+	}
+	if !ok {
+		return &authpb.IntrospectResponse{}, nil
+	}
+
+	var cnf string
+	if c.Confirmation != nil {
+		cnf = c.Confirmation.X5tS256
+	}
+
+	return &authpb.IntrospectResponse{
+		Active:      true,
+		Sub:         c.Subject,
+		User:        c.User,
+		Email:       c.Email,
+		Roles:       c.Roles,
+		Permissions: c.Permissions,
+		Iss:         c.Issuer,
+		Aud:         c.Audience,
+		Iat:         c.IssuedAt,
+		Exp:         c.ExpiresAt,
+		CnfX5TS256:  cnf,
+	}, nil
+}
+
+// GetUser returns the caller, or any user for callers allowed to read users
+func (s *grpcServer) GetUser(ctx context.Context, req *authpb.GetUserRequest) (*authpb.User, error) {
+	token := bearerFromMetadata(ctx)
+
+	// looking at yourself needs no permission, but
+	// the token must be checked before trusting its sub
+	c, rerr := s.ah.verifyToken(ctx, token, "")
+	if rerr == nil {
+		rerr = checkBinding(ctx, c, grpcDevice(ctx))
+	}
+	if rerr != nil {
+		return nil, grpcError(rerr)
+	}
+
+	id := req.Id
+	if id == "" {
+		id = c.Subject
+	}
+
+	if id != c.Subject && !c.HasPermission(access.PermUsersRead) {
+		logger(ctx).Warnf("user %s lacks permission %s", c.Subject, access.PermUsersRead)
+		return nil, status.Error(codes.PermissionDenied, "missing permission "+access.PermUsersRead)
+	}
+
+	u, err := s.ah.FindUserByID(ctx, id)
+	if err != nil {
+		logger(ctx).Warnf("could not find user %s: %s", id, err)
+		return nil, status.Error(codes.NotFound, "Not Found")
+	}
+
+	return &authpb.User{
+		Id:          u.ID,
+		Name:        u.Name,
+		Email:       u.Email,
+		CreatedAt:   u.CreatedAt,
+		Roles:       u.Roles,
+		Permissions: u.Permissions,
+		Disabled:    u.Disabled,
+	}, nil
+}
+
+// grpcError converts the errors shared with the HTTP handlers
+func grpcError(rerr *responseError) error {
+	code, ok := grpcCodes[rerr.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+
+	msg := rerr.Cause
+	if msg == "" {
+		msg = rerr.Description
+	}
+	return status.Error(code, msg)
+}
+
+// grpcDevice describes the client of a call, the same way
+// ah.device does for HTTP requests
+func grpcDevice(ctx context.Context) access.Device {
+	d := access.Device{}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ua := md.Get("user-agent"); len(ua) > 0 {
+		d.UserAgent = ua[0]
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			d.IP = host
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			d.CertThumbprint = access.CertThumbprint(info.State.VerifiedChains[0][0].Raw)
+		}
+	}
+	return d
+}
+
+// bearerFromMetadata extracts the token from the authorization metadata
+func bearerFromMetadata(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, h := range md.Get("authorization") {
+		if t := bearerFromHeader(h); t != "" {
+			return t
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/betalotest/auth/authpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCServer(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	srv := grpcEngine(acc, conf)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("could not dial grpc server: %s", err)
+	}
+	defer conn.Close()
+
+	c := authpb.NewAuthClient(conn)
+	ctx := context.Background()
+
+	tt := []struct {
+		label string
+		call  func() error
+		code  codes.Code
+		msg   string
+	}{
+		{"signup missing data", func() error {
+			_, err := c.Signup(ctx, &authpb.SignupRequest{Username: "xablau"})
+			return err
+		}, codes.InvalidArgument, "missing form data"},
+		{"signup invalid email", func() error {
+			_, err := c.Signup(ctx, &authpb.SignupRequest{Username: "xablau", Email: "xablau@xmail,com", Password: "foobar321", PasswordCheck: "foobar321"})
+			return err
+		}, codes.InvalidArgument, "invalid email"},
+		{"issue token invalid email", func() error {
+			_, err := c.IssueToken(ctx, &authpb.IssueTokenRequest{Email: "xablau@xmail,com", Password: "foobar321"})
+			return err
+		}, codes.InvalidArgument, "invalid email"},
+		{"refresh invalid token", func() error {
+			_, err := c.RefreshToken(ctx, &authpb.RefreshTokenRequest{Token: "xablau"})
+			return err
+		}, codes.Unauthenticated, "invalid token"},
+		{"refresh personal token", func() error {
+			_, err := c.RefreshToken(ctx, &authpb.RefreshTokenRequest{Token: "pat_xablau"})
+			return err
+		}, codes.PermissionDenied, "personal access token not allowed"},
+		{"revoke personal token", func() error {
+			_, err := c.RevokeToken(ctx, &authpb.RevokeTokenRequest{Token: "pat_xablau"})
+			return err
+		}, codes.PermissionDenied, "personal access token not allowed"},
+		{"revoke missing token", func() error {
+			_, err := c.RevokeToken(ctx, &authpb.RevokeTokenRequest{})
+			return err
+		}, codes.Unauthenticated, "missing bearer token"},
+		{"get user missing token", func() error {
+			_, err := c.GetUser(ctx, &authpb.GetUserRequest{})
+			return err
+		}, codes.Unauthenticated, "missing bearer token"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			s, _ := status.FromError(tc.call())
+			if s.Code() != tc.code || s.Message() != tc.msg {
+				t.Errorf("expected %s '%s'; got %s '%s'", tc.code, tc.msg, s.Code(), s.Message())
+			}
+		})
+	}
+
+	t.Run("introspect invalid token", func(t *testing.T) {
+		resp, err := c.Introspect(ctx, &authpb.IntrospectRequest{Token: "xablau"})
+		if err != nil {
+			t.Fatalf("could not introspect: %s", err)
+		}
+		if resp.Active {
+			t.Error("expected invalid token to be inactive")
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/betalotest/auth/server/access"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the wait between attempts to connect to the db at startup
+	// doubles from minConnectBackoff up to maxConnectBackoff
+	minConnectBackoff = time.Second
+	maxConnectBackoff = 30 * time.Second
+)
+
+// healthResponse is the body of the health endpoints, Checks
+// holds 'ok' or the failure of each readiness check
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// connect gets access to the db, retrying with backoff for up to retry
+// while it can't be reached at startup. A zero retry tries only once,
+// configuration errors are never retried
+func connect(configfile string, retry time.Duration) (*access.Access, error) {
+	deadline := time.Now().Add(retry)
+	wait := minConnectBackoff
+
+	for {
+		acc, err := access.New(configfile)
+		if err == nil {
+			return acc, nil
+		}
+		if _, unreachable := err.(*access.DialError); !unreachable || time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+
+		log.Warnf("could not get access, retrying in %s: %s", wait, err)
+		time.Sleep(wait)
+
+		if wait *= 2; wait > maxConnectBackoff {
+			wait = maxConnectBackoff
+		}
+	}
+}
+
+// getHealthzHandler reports the process is alive, nothing else is checked
+func getHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	renderJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// getReadyzHandler reports whether the server can handle requests: the
+// db answers, the templates are loaded and there is a key to sign tokens
+func (ah *accessHandler) getReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"storage":     "ok",
+		"templates":   "ok",
+		"signing_key": "ok",
+	}
+	ready := true
+
+	if err := ah.Ping(r.Context()); err != nil {
+		// the db error stays in the logs, it may tell about the deployment
+		logger(r.Context()).Warnf("readiness check failed, db ping: %s", err)
+		checks["storage"] = "unavailable"
+		ready = false
+	}
+
+	if ah.tmplHandler == nil || ah.Template == nil || ah.Lookup("error.tmpl") == nil {
+		checks["templates"] = "not loaded"
+		ready = false
+	}
+
+	if ah.Signature == "" {
+		checks["signing_key"] = "missing"
+		ready = false
+	}
+
+	if !ready {
+		renderJSON(w, http.StatusServiceUnavailable, healthResponse{"unavailable", checks})
+		return
+	}
+	renderJSON(w, http.StatusOK, healthResponse{"ok", checks})
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/betalotest/auth/server/access"
+)
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	getHealthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+
+	if w.Code != 200 {
+		t.Errorf("expected status code 200; got %d", w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tt := []struct {
+		label  string
+		ah     *accessHandler
+		checks map[string]string
+	}{
+		{
+			"no db",
+			&accessHandler{acc, &tmplHandler{tmpl}, conf},
+			map[string]string{"storage": "unavailable", "templates": "ok", "signing_key": "ok"},
+		},
+		{
+			"nothing ready",
+			&accessHandler{&access.Access{}, nil, conf},
+			map[string]string{"storage": "unavailable", "templates": "not loaded", "signing_key": "missing"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.ah.getReadyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+
+			if w.Code != 503 {
+				t.Errorf("expected status code 503; got %d", w.Code)
+			}
+
+			var resp healthResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("could not decode response: %s", err)
+			}
+
+			if resp.Status != "unavailable" || !reflect.DeepEqual(resp.Checks, tc.checks) {
+				t.Errorf("expected unavailable with checks %v; got %s %v", tc.checks, resp.Status, resp.Checks)
+			}
+		})
+	}
+}
+
+func TestConnectConfigError(t *testing.T) {
+	start := time.Now()
+
+	// a broken configuration won't get better by waiting
+	if _, err := connect("missing/conf.yml", time.Minute); err == nil {
+		t.Fatalf("expected an error for a missing configuration file")
+	}
+	if waited := time.Since(start); waited >= minConnectBackoff {
+		t.Errorf("expected no retries for configuration errors; waited %s", waited)
+	}
+}
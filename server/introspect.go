@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/betalotest/auth/server/access"
+)
+
+// postIntrospectHandler tells token holders and downstream services
+// whether a token is active, RFC 7662 style. Inactive tokens get no
+// details on why, active ones get their claims
+func (ah *accessHandler) postIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logger(r.Context()).Warnf("could not parse introspection form: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid form data",
+		})
+		return
+	}
+
+	token := r.Form.Get("token")
+	if token == "" {
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "missing form data",
+		})
+		return
+	}
+
+	c, ok, rerr := ah.introspect(r.Context(), token)
+	if rerr != nil {
+		renderJSONError(w, *rerr)
+		return
+	}
+	if !ok {
+		renderJSON(w, http.StatusOK, struct {
+			Active bool `json:"active"`
+		}{})
+		return
+	}
+
+	resp := struct {
+		Active bool `json:"active"`
+		*access.Claim
+	}{
+		true,
+		c,
+	}
+	renderJSON(w, http.StatusOK, resp)
+}
+
+// introspect returns the claims of token and whether it is active.
+// When the server can't tell, the error is returned instead
+func (ah *accessHandler) introspect(ctx context.Context, token string) (*access.Claim, bool, *responseError) {
+	c, rerr := ah.verifyToken(ctx, token, "")
+	if rerr != nil && rerr.Code >= http.StatusInternalServerError {
+		return nil, false, rerr
+	}
+	if rerr != nil {
+		logger(ctx).Infof("introspected inactive token: %s", rerr.Cause)
+		return nil, false, nil
+	}
+	return c, true, nil
+}
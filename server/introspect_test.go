@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPostIntrospectHandler(t *testing.T) {
+	tt := []struct {
+		label      string
+		token      string
+		body       string
+		statusCode int
+	}{
+		{"missing token", "", "missing form data", 400},
+		{"invalid token", "xablau", `{"active":false}`, 200},
+	}
+
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			resp, err := http.PostForm(srv.URL+"/introspect", url.Values{"token": {tc.token}})
+			if err != nil {
+				t.Fatalf("could not execute post resquest: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+
+			var b bytes.Buffer
+			if _, err := io.Copy(&b, resp.Body); err != nil {
+				t.Errorf("failed to copy response body: %s", err)
+			}
+
+			if !strings.Contains(b.String(), tc.body) {
+				t.Errorf("expected body to have %s; got %s", tc.body, b.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/betalotest/auth/server/validation"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+)
+
+const (
+	defaultInviteDays = 7
+	maxInviteDays     = 90
+)
+
+// createdInviteResponse is a newly created invite, the
+// only time its code and the signup link are shown
+type createdInviteResponse struct {
+	Code string `json:"code"`
+	Link string `json:"link"`
+	access.Invite
+}
+
+// listInvitesHandler render every invite, used or not
+func (ah *accessHandler) listInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	invites, err := ah.ListInvites(r.Context())
+	if err != nil {
+		logger(r.Context()).Warnf("could not list invites: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	renderJSON(w, http.StatusOK, struct {
+		Invites []access.Invite `json:"invites"`
+	}{invites})
+}
+
+// postInviteHandler create an invite from the optional email and
+// expires_in_days of the JSON body, along with its signup link
+func (ah *accessHandler) postInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email         string `json:"email"`
+		ExpiresInDays int    `json:"expires_in_days"`
+	}
+
+	// the body is optional
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		logger(r.Context()).Warnf("could not decode invite request body: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid json body",
+		})
+		return
+	}
+
+	if body.Email != "" {
+		if err := validation.ValidateEmail(body.Email); err != nil {
+			logger(r.Context()).Warnf("could not validate invite email: %s", err)
+			renderJSONError(w, responseError{
+				Code:        http.StatusBadRequest,
+				Description: "Bad Request",
+				Cause:       "invalid email",
+			})
+			return
+		}
+	}
+
+	if body.ExpiresInDays == 0 {
+		body.ExpiresInDays = defaultInviteDays
+	}
+	if body.ExpiresInDays < 1 || body.ExpiresInDays > maxInviteDays {
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid expires_in_days",
+		})
+		return
+	}
+
+	actor := claimFromContext(r.Context()).Subject
+	expiresAt := time.Now().AddDate(0, 0, body.ExpiresInDays).Unix()
+
+	code, inv, err := ah.NewInvite(r.Context(), actor, body.Email, expiresAt)
+	if err != nil {
+		logger(r.Context()).Warnf("could not create invite: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	ah.audit(r.Context(), access.AuditEvent{Action: access.AuditInviteCreated, Actor: actor, Target: inv.ID}, ah.device(r))
+
+	logger(r.Context()).Infof("invite %s created by %s", inv.ID, actor)
+
+	link := ah.conf.publicURL + "/signup?invite=" + url.QueryEscape(code)
+	renderJSON(w, http.StatusCreated, createdInviteResponse{code, link, inv})
+}
+
+// deleteInviteHandler remove an invite, so its code can't be redeemed
+func (ah *accessHandler) deleteInviteHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	if err := ah.DeleteInvite(r.Context(), id); err != nil {
+		if errors.Cause(err) == mgo.ErrNotFound {
+			renderJSONError(w, responseError{
+				Code:        http.StatusNotFound,
+				Description: "Not Found",
+			})
+			return
+		}
+
+		logger(r.Context()).Warnf("could not delete invite %s: %s", id, err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	actor := claimFromContext(r.Context()).Subject
+	ah.audit(r.Context(), access.AuditEvent{Action: access.AuditInviteDeleted, Actor: actor, Target: id}, ah.device(r))
+
+	logger(r.Context()).Infof("invite %s deleted by %s", id, actor)
+	w.WriteHeader(http.StatusNoContent)
+}
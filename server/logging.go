@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/betalotest/auth/server/logging"
+	"github.com/betalotest/auth/server/tracing"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// requestIDHeader carries the ID of a request, taken from the
+// client or proxy when valid and generated otherwise
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs taken from clients
+const maxRequestIDLength = 128
+
+// validRequestID matches the request IDs taken from clients,
+// anything else could forge log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// accessLog writes one JSON line per request
+var accessLog = newAccessLogger()
+
+func newAccessLogger() *log.Logger {
+	l := log.New()
+	l.Formatter = &log.JSONFormatter{}
+	l.AddHook(logging.RedactHook{})
+	return l
+}
+
+// requestID returns the request ID id sent by the client,
+// or a new one when it sent none or an invalid one
+func requestID(id string) string {
+	if len(id) > maxRequestIDLength || !validRequestID.MatchString(id) {
+		return uuid.New().String()
+	}
+	return id
+}
+
+// requestLogger returns the log entry of the request id, along
+// with the trace it belongs to when ctx carries one
+func requestLogger(ctx context.Context, id string) *log.Entry {
+	e := log.WithField(logging.RequestIDField, id)
+	if tid := tracing.TraceID(ctx); tid != "" {
+		e = e.WithField(logging.TraceIDField, tid)
+	}
+	return e
+}
+
+// logger returns the request scoped log entry of ctx
+func logger(ctx context.Context) *log.Entry {
+	return logging.FromContext(ctx)
+}
@@ -0,0 +1,118 @@
+// Package logging carries the request scoped logger of the auth server
+// through contexts and keeps secrets out of what gets logged
+package logging
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fields of request scoped log entries
+const (
+	RequestIDField = "request_id"
+	TraceIDField   = "trace_id"
+)
+
+// redacted replaces the values of sensitive fields and query parameters
+const redacted = "[REDACTED]"
+
+// sensitive lists the field and query parameter names never logged as is
+var sensitive = map[string]bool{
+	"password":      true,
+	"passwordcheck": true,
+	"token":         true,
+	"refresh_token": true,
+	"access_token":  true,
+	"secret":        true,
+	"code":          true,
+	"invite":        true,
+	"authorization": true,
+	"cookie":        true,
+}
+
+// bearer matches bearer credentials within log messages
+var bearer = regexp.MustCompile(`(?i)(bearer\s+)[^\s"]+`)
+
+// queryParam matches the query parameters of the URLs within text
+var queryParam = regexp.MustCompile(`([?&]([^=&#\s]+)=)[^&#\s]*`)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the log entry e
+func NewContext(ctx context.Context, e *log.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns the log entry of ctx, or an entry of the
+// standard logger when ctx carries none
+func FromContext(ctx context.Context) *log.Entry {
+	if ctx != nil {
+		if e, ok := ctx.Value(contextKey{}).(*log.Entry); ok {
+			return e
+		}
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// Sensitive - check if values named name must be redacted
+func Sensitive(name string) bool {
+	return sensitive[strings.ToLower(name)]
+}
+
+// RedactQuery - the path and query of u with the values
+// of sensitive query parameters redacted
+func RedactQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.Path
+	}
+
+	for k, vs := range q {
+		if Sensitive(k) {
+			for i := range vs {
+				vs[i] = redacted
+			}
+		}
+	}
+	return u.Path + "?" + q.Encode()
+}
+
+// RedactURLs - text with the values of the sensitive
+// query parameters of the URLs in it redacted
+func RedactURLs(text string) string {
+	return queryParam.ReplaceAllStringFunc(text, func(p string) string {
+		m := queryParam.FindStringSubmatch(p)
+		if !Sensitive(m[2]) {
+			return p
+		}
+		return m[1] + redacted
+	})
+}
+
+// RedactHook redacts the sensitive fields of every entry it fires for
+type RedactHook struct{}
+
+// Levels - the hook fires for all levels
+func (RedactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire replaces the values of sensitive fields, the bearer
+// credentials and the sensitive URL parameters in the message
+func (RedactHook) Fire(e *log.Entry) error {
+	e.Message = RedactURLs(bearer.ReplaceAllString(e.Message, "${1}"+redacted))
+	for k := range e.Data {
+		if Sensitive(k) {
+			e.Data[k] = redacted
+		}
+	}
+	return nil
+}
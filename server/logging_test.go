@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/betalotest/auth/server/logging"
+)
+
+func TestRequestID(t *testing.T) {
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	tt := []struct {
+		label string
+		id    string
+		keep  bool
+	}{
+		{"generated", "", false},
+		{"propagated", "7d0ab1c4-req", true},
+		{"invalid replaced", `bad id "forged"`, false},
+		{"too long replaced", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req, err := http.NewRequest("GET", srv.URL+"/login/magic", nil)
+			if err != nil {
+				t.Fatalf("could not create request: %s", err)
+			}
+			if tc.id != "" {
+				req.Header.Set(requestIDHeader, tc.id)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute request: %s", err)
+			}
+			resp.Body.Close()
+
+			got := resp.Header.Get(requestIDHeader)
+			if got == "" {
+				t.Fatal("expected a request id")
+			}
+			if (got == tc.id) != tc.keep {
+				t.Errorf("expected keeping %q to be %t; got %q", tc.id, tc.keep, got)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	out := accessLog.Out
+	accessLog.Out = buf
+	defer func() { accessLog.Out = out }()
+
+	ah := &accessHandler{acc, &tmplHandler{tmpl}, conf}
+	h := ah.instrument("GET", "/login/magic/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if logging.FromContext(r.Context()).Data[logging.RequestIDField] != "abc-123" {
+			t.Error("expected the request logger in the handler context")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	req := httptest.NewRequest("GET", "/login/magic/confirm?token=s3cret", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	req.RemoteAddr = "10.0.0.7:4242"
+	h(httptest.NewRecorder(), req)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a json access log; got %s", buf.String())
+	}
+
+	tt := []struct {
+		label string
+		field string
+		want  interface{}
+	}{
+		{"request id", "request_id", "abc-123"},
+		{"method", "method", "GET"},
+		{"route", "route", "/login/magic/confirm"},
+		{"status", "status", float64(http.StatusTeapot)},
+		{"client ip", "client_ip", "10.0.0.7"},
+		{"redacted path", "path", "/login/magic/confirm?token=%5BREDACTED%5D"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if line[tc.field] != tc.want {
+				t.Errorf("expected %s %v; got %v", tc.field, tc.want, line[tc.field])
+			}
+		})
+	}
+
+	if _, ok := line["latency_ms"]; !ok {
+		t.Error("expected the latency to be logged")
+	}
+}
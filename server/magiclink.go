@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/betalotest/auth/server/validation"
+)
+
+// magicLinkSent is the answer to every valid login link request,
+// whether the email belongs to a user or not
+const magicLinkSent = "if the email belongs to an account, a sign in link is on its way"
+
+// getMagicLinkHandler render a template for requesting a login link
+func (th *tmplHandler) getMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	if err := th.ExecuteTemplate(w, "magiclink_form.tmpl", formData(r, nil)); err != nil {
+		logger(r.Context()).Warnf("could not execute magic link tmpl for get request: %s", err)
+		renderError(w, r, th.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+	}
+}
+
+// postMagicLinkHandler emails a login link to the user with the
+// given email. The answer is the same for unknown emails, so the
+// endpoint can't be used to find out who has an account. Without an
+// SMTP server to send the link through the answer is 503
+func (ah *accessHandler) postMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logger(r.Context()).Warnf("could not parse magic link form: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	email := html.EscapeString(r.Form.Get("email"))
+	if err := validation.ValidateEmail(email); err != nil {
+		logger(r.Context()).Warnf("could not validate email: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid email",
+		})
+		return
+	}
+
+	if !ah.conf.deliversMail() {
+		logger(r.Context()).Warn("no smtp server to send login links through")
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusServiceUnavailable,
+			Description: "Service Unavailable",
+			Cause:       "login links are not available",
+		})
+		return
+	}
+
+	ah.sendMagicLink(r.Context(), email)
+
+	if wantsJSON(r) {
+		renderJSON(w, http.StatusAccepted, struct {
+			Message string `json:"message"`
+		}{magicLinkSent})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	if err := ah.ExecuteTemplate(w, "magiclink_sent.tmpl", formData(r, magicLinkSent)); err != nil {
+		logger(r.Context()).Warnf("could not execute magic link sent tmpl: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+	}
+}
+
+// sendMagicLink creates a login link for the user with the given email
+// and mails it in the background, failures are only logged
+func (ah *accessHandler) sendMagicLink(ctx context.Context, email string) {
+	user, err := ah.FindUserByEmail(ctx, email)
+	if err != nil {
+		logger(ctx).Warnf("could not find user %s for magic link: %s", email, err)
+		return
+	}
+
+	if user.Disabled {
+		logger(ctx).Warnf("user %s is disabled, no magic link sent", user.Email)
+		return
+	}
+
+	secret, err := ah.NewMagicLink(ctx, user)
+	if err == access.ErrMagicLinkTooSoon {
+		logger(ctx).Warnf("user %s asked for magic links too often, none sent", user.Email)
+		return
+	}
+	if err != nil {
+		logger(ctx).Errorf("could not create magic link for user %s: %s", user.Email, err)
+		return
+	}
+
+	link := ah.conf.publicURL + "/login/magic/confirm?token=" + url.QueryEscape(secret)
+	body := "Follow this link to sign in, it works once and expires in " + ah.MagicLinkTTL.String() + ":\n\n" +
+		link + "\n\nIf you didn't ask for it, you can ignore this email.\n"
+
+	go func() {
+		if err := ah.conf.mailer.Send(user.Email, "Your sign in link", body); err != nil {
+			logger(ctx).Errorf("could not send magic link to user %s: %s", user.Email, err)
+			return
+		}
+		logger(ctx).Infof("magic link sent to user %s", user.Email)
+	}()
+}
+
+// getMagicLinkConfirmHandler render a template asking the user to confirm
+// the login link. Only submitting it uses the link, so mail scanners and
+// browsers prefetching the link don't burn it
+func (th *tmplHandler) getMagicLinkConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	// keep the link out of caches and of the referer of other sites
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	w.WriteHeader(http.StatusOK)
+	if err := th.ExecuteTemplate(w, "magiclink_confirm.tmpl", formData(r, r.URL.Query().Get("token"))); err != nil {
+		logger(r.Context()).Warnf("could not execute magic link confirm tmpl: %s", err)
+		renderError(w, r, th.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+	}
+}
+
+// postMagicLinkConfirmHandler uses up the login link
+// and logs its owner in, as postTokenHandler does
+func (ah *accessHandler) postMagicLinkConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logger(r.Context()).Warnf("could not parse magic link confirm form: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	token := r.Form.Get("token")
+	if token == "" {
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "missing form data",
+		})
+		return
+	}
+
+	invalid := responseError{
+		Code:        http.StatusUnauthorized,
+		Description: "Unauthorized",
+		Cause:       "invalid magic link",
+	}
+
+	// the link is only used up once its owner may log in,
+	// so it still works after the lock or the reset
+	owner, err := ah.MagicLinkOwner(r.Context(), token)
+	if err != nil {
+		logger(r.Context()).Warnf("could not find magic link owner: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), invalid)
+		return
+	}
+
+	if owner.Locked(time.Now()) {
+		logger(r.Context()).Warnf("user %s is locked", owner.Email)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusForbidden,
+			Description: "Forbidden",
+			Cause:       "account locked",
+		})
+		return
+	}
+
+	if rerr := checkPasswordReset(r.Context(), owner); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	user, err := ah.ConsumeMagicLink(r.Context(), token)
+	if err != nil {
+		logger(r.Context()).Warnf("could not use magic link: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), invalid)
+		return
+	}
+
+	// following the emailed link proves owning the email
+	verified, err := ah.MarkEmailVerified(r.Context(), user.ID)
+	if err != nil {
+		logger(r.Context()).Errorf("could not mark email of user %s verified: %s", user.Email, err)
+	}
+	if verified {
+		ah.notify(r.Context(), access.WebhookUserVerified, access.NewUserData(user))
+	}
+
+	logger(r.Context()).Infof("user %s signed in with a magic link", user.Email)
+	ah.login(w, r, user, "magic link")
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGetMagicLinkConfirmHandler(t *testing.T) {
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/login/magic/confirm?token=xablau.foobar")
+	if err != nil {
+		t.Fatalf("could not execute GET request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("expected status 200; got %d", resp.StatusCode)
+	}
+
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("expected Cache-Control 'no-store'; got '%s'", cc)
+	}
+
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, resp.Body); err != nil {
+		t.Fatalf("failed to copy response body: %s", err)
+	}
+
+	// the link is only used once the form is submitted
+	if !strings.Contains(b.String(), `name="token" value="xablau.foobar"`) {
+		t.Errorf("expected confirm form to carry the token; got %s", b.String())
+	}
+}
+
+func TestPostMagicLinkHandlers(t *testing.T) {
+	tt := []struct {
+		label      string
+		path       string
+		form       url.Values
+		cause      string
+		statusCode int
+	}{
+		{"invalid email", "/login/magic", url.Values{"email": {"xablau@xmail,com"}}, "invalid email", 400},
+		{"no smtp server", "/login/magic", url.Values{"email": {"xablau@xmail.com"}}, "login links are not available", 503},
+		{"missing token", "/login/magic/confirm", url.Values{}, "missing form data", 400},
+		{"unsigned token", "/login/magic/confirm", url.Values{"token": {"xablau"}}, "invalid magic link", 401},
+		{"forged token", "/login/magic/confirm", url.Values{"token": {"xablau.foobar"}}, "invalid magic link", 401},
+	}
+
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req, err := http.NewRequest("POST", srv.URL+tc.path, strings.NewReader(tc.form.Encode()))
+			if err != nil {
+				t.Fatalf("could not create post request: %s", err)
+			}
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(req)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute post resquest: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+
+			var b bytes.Buffer
+			if _, err := io.Copy(&b, resp.Body); err != nil {
+				t.Errorf("failed to copy response body: %s", err)
+			}
+
+			if !strings.Contains(b.String(), tc.cause) {
+				t.Errorf("expected error message to have cause %s; got %s", tc.cause, b.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Package mail sends the emails of the auth server
+package mail
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/betalotest/auth/server/logging"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mailer sends a plain text email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTP sends emails through an SMTP server, authenticating
+// with PLAIN auth when Username is set
+type SMTP struct {
+	Address  string
+	From     string
+	Username string
+	Password string
+}
+
+// Send - deliver the email through the SMTP server
+func (m SMTP) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid header value for email to '%s'", to)
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Address)
+		if err != nil {
+			return errors.Wrap(err, "invalid smtp address "+m.Address)
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.Replace(body, "\n", "\r\n", -1)
+
+	if err := smtp.SendMail(m.Address, auth, m.From, []string{to}, []byte(msg)); err != nil {
+		return errors.Wrap(err, "could not send email to "+to)
+	}
+	return nil
+}
+
+// Log writes emails to the log instead of sending them,
+// for development setups without an SMTP server. Secrets in
+// the links of the emails are redacted
+type Log struct{}
+
+// Send - log the email
+func (Log) Send(to, subject, body string) error {
+	log.Infof("email to %s, subject '%s':\n%s", to, subject, logging.RedactURLs(body))
+	return nil
+}
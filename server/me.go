@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// sessionResponse is an active session of the caller,
+// Current tells the one the request was made with
+type sessionResponse struct {
+	access.ActiveSession
+	Current bool `json:"current"`
+}
+
+// getSessionsHandler lists the browser sessions and tokens of the caller
+func (ah *accessHandler) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if rerr := rejectPersonalToken(bearerToken(r)); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	c := claimFromContext(r.Context())
+
+	active, err := ah.ListSessions(r.Context(), c.Subject)
+	if err != nil {
+		logger(r.Context()).Warnf("could not list sessions for user %s: %s", c.Subject, err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	sessions := make([]sessionResponse, len(active))
+	for i, s := range active {
+		sessions[i] = sessionResponse{s, s.ID == c.Id}
+	}
+
+	if wantsJSON(r) {
+		renderJSON(w, http.StatusOK, struct {
+			Sessions []sessionResponse `json:"sessions"`
+		}{sessions})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := ah.ExecuteTemplate(w, "sessions.tmpl", formData(r, sessions)); err != nil {
+		logger(r.Context()).Warnf("could not execute sessions tmpl: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+	}
+}
+
+// postRevokeSessionHandler ends one browser session or token of the caller
+func (ah *accessHandler) postRevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if rerr := rejectPersonalToken(bearerToken(r)); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	c := claimFromContext(r.Context())
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	if err := ah.RevokeSession(r.Context(), c.Subject, id); err != nil {
+		if errors.Cause(err) == mgo.ErrNotFound {
+			renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+				Code:        http.StatusNotFound,
+				Description: "Not Found",
+			})
+			return
+		}
+
+		logger(r.Context()).Warnf("could not revoke session %s for user %s: %s", id, c.Subject, err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	logger(r.Context()).Infof("session %s revoked for user %s", id, c.Subject)
+	ah.audit(r.Context(), access.AuditEvent{Action: access.AuditSessionRevoked, Actor: c.Subject, Target: id}, ah.device(r))
+
+	if id == c.Id {
+		ah.setSessionCookie(w, "", -1)
+	}
+	ah.signedOut(w, r, id != c.Id)
+}
+
+// postSignoutEverywhereHandler ends every browser session
+// and revokes every token of the caller
+func (ah *accessHandler) postSignoutEverywhereHandler(w http.ResponseWriter, r *http.Request) {
+	if rerr := rejectPersonalToken(bearerToken(r)); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	if rerr := ah.revokeTokens(r.Context(), claimFromContext(r.Context()), ah.device(r)); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	ah.setSessionCookie(w, "", -1)
+	ah.signedOut(w, r, false)
+}
+
+// signedOut answers API clients with no content and sends browsers back
+// to the sessions page or, when their own session is gone, to the login form
+func (ah *accessHandler) signedOut(w http.ResponseWriter, r *http.Request, stillIn bool) {
+	switch {
+	case wantsJSON(r):
+		w.WriteHeader(http.StatusNoContent)
+	case stillIn:
+		http.Redirect(w, r, "/me/sessions", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/token", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/betalotest/auth/server/access"
+)
+
+func TestMeSessionsRoutes(t *testing.T) {
+	tt := []struct {
+		label      string
+		method     string
+		path       string
+		accept     string
+		auth       string
+		csrf       bool
+		cause      string
+		statusCode int
+	}{
+		{"browser without session", "GET", "/me/sessions", "", "", false, "", 303},
+		{"api missing token", "GET", "/me/sessions", "application/json", "", false, "missing bearer token", 401},
+		{"api invalid token", "GET", "/me/sessions", "application/json", "Bearer xablau", false, "invalid token", 401},
+		{"revoke missing csrf", "POST", "/me/sessions/9b2e7c4a/revoke", "", "", false, "invalid csrf token", 403},
+		{"revoke browser without session", "POST", "/me/sessions/9b2e7c4a/revoke", "", "", true, "", 303},
+		{"revoke invalid token", "POST", "/me/sessions/9b2e7c4a/revoke", "application/json", "Bearer xablau", false, "invalid token", 401},
+		{"signout everywhere missing token", "POST", "/me/signout-everywhere", "application/json", "", false, "missing bearer token", 401},
+	}
+
+	// don't follow the redirect to the login form
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+			if err != nil {
+				t.Fatalf("could not create request: %s", err)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			if tc.csrf {
+				addCSRF(req)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute request: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+
+			if tc.statusCode == 303 && resp.Header.Get("Location") != "/token" {
+				t.Errorf("expected redirect to /token; got '%s'", resp.Header.Get("Location"))
+			}
+
+			var b bytes.Buffer
+			if _, err := io.Copy(&b, resp.Body); err != nil {
+				t.Fatalf("failed to copy response body: %s", err)
+			}
+
+			if !strings.Contains(b.String(), tc.cause) {
+				t.Errorf("expected response to have cause %s; got %s", tc.cause, b.String())
+			}
+		})
+	}
+}
+
+func TestRejectPersonalToken(t *testing.T) {
+	ah := &accessHandler{acc, &tmplHandler{tmpl}, conf}
+
+	tt := []struct {
+		label   string
+		method  string
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"list", "GET", "/me/sessions", ah.getSessionsHandler},
+		{"revoke", "POST", "/me/sessions/9b2e7c4a/revoke", ah.postRevokeSessionHandler},
+		{"signout everywhere", "POST", "/me/signout-everywhere", ah.postSignoutEverywhereHandler},
+		{"revoke tokens", "POST", "/token/revoke", ah.postRevokeHandler},
+	}
+
+	// what requireLogin leaves for a valid personal access token
+	c := &access.Claim{}
+	c.Subject = "4f1c6b1e"
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			r.Header.Set("Accept", "application/json")
+			r.Header.Set("Authorization", "Bearer pat_xablau")
+			r = r.WithContext(context.WithValue(r.Context(), claimKey, c))
+
+			w := httptest.NewRecorder()
+			tc.handler(w, r)
+
+			if w.Code != http.StatusForbidden {
+				t.Errorf("expected status code 403; got %d", w.Code)
+			}
+
+			if !strings.Contains(w.Body.String(), "personal access token not allowed") {
+				t.Errorf("expected response to reject the personal token; got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDevice(t *testing.T) {
+	tt := []struct {
+		label  string
+		header string
+		remote string
+		value  string
+		ip     string
+	}{
+		{"remote addr", "", "10.0.0.1:51234", "", "10.0.0.1"},
+		{"ignored header", "", "10.0.0.1:51234", "203.0.113.7", "10.0.0.1"},
+		{"real ip", "X-Real-IP", "10.0.0.1:51234", "203.0.113.7", "203.0.113.7"},
+		{"forwarded for", "X-Forwarded-For", "10.0.0.1:51234", "203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"spoofed forwarded for", "X-Forwarded-For", "10.0.0.1:51234", "198.51.100.9, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"only proxies", "X-Forwarded-For", "10.0.0.1:51234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"malformed hop", "X-Forwarded-For", "10.0.0.1:51234", "xablau, 203.0.113.7", "203.0.113.7"},
+		{"malformed last hop", "X-Forwarded-For", "10.0.0.1:51234", "203.0.113.7, xablau", "10.0.0.1"},
+		{"untrusted remote", "X-Real-IP", "192.0.2.1:51234", "203.0.113.7", "192.0.2.1"},
+		{"missing header", "X-Real-IP", "10.0.0.1:51234", "", "10.0.0.1"},
+	}
+
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("could not parse trusted proxies: %s", err)
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			ah := &accessHandler{acc, nil, &config{trustedProxies: proxies, clientIPHeader: tc.header}}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			r.Header.Set("User-Agent", "xablau/1.0")
+			if tc.value != "" {
+				r.Header.Set("X-Real-IP", tc.value)
+				r.Header.Set("X-Forwarded-For", tc.value)
+			}
+
+			d := ah.device(r)
+			if d.IP != tc.ip {
+				t.Errorf("expected ip '%s'; got '%s'", tc.ip, d.IP)
+			}
+			if d.UserAgent != "xablau/1.0" {
+				t.Errorf("expected user agent 'xablau/1.0'; got '%s'", d.UserAgent)
+			}
+		})
+	}
+}
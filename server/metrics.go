@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/betalotest/auth/server/logging"
+	"github.com/betalotest/auth/server/metrics"
+	"github.com/betalotest/auth/server/tracing"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// instrumentedRouter records request metrics, traces and access logs
+// for every handler registered on it, labeled with its route pattern
+type instrumentedRouter struct {
+	*httprouter.Router
+	ah *accessHandler
+}
+
+// HandlerFunc registers the instrumented h for method and path
+func (r instrumentedRouter) HandlerFunc(method, path string, h http.HandlerFunc) {
+	r.Router.HandlerFunc(method, path, r.ah.instrument(method, path, h))
+}
+
+// statusWriter remembers the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// instrument tags the requests handled by h with a request ID and a span,
+// continuing the trace of the traceparent header, and passes a logger
+// with both down the request context. Then counts, times and access
+// logs the requests
+func (ah *accessHandler) instrument(method, route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := requestID(r.Header.Get(requestIDHeader))
+		w.Header().Set(requestIDHeader, id)
+
+		ctx, span := tracing.StartServer(r.Context(), propagation.HeaderCarrier(r.Header), method+" "+route,
+			semconv.HTTPRequestMethodKey.String(method),
+			semconv.HTTPRoute(route),
+		)
+		entry := requestLogger(ctx, id)
+		r = r.WithContext(logging.NewContext(ctx, entry))
+
+		sw := &statusWriter{ResponseWriter: w}
+		h(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+		span.End()
+
+		status := strconv.Itoa(sw.status)
+		latency := time.Since(start)
+
+		metrics.Requests.WithLabelValues(method, route, status).Inc()
+		metrics.RequestDuration.WithLabelValues(method, route, status).Observe(latency.Seconds())
+
+		accessLog.WithFields(entry.Data).WithFields(log.Fields{
+			"method":     method,
+			"route":      route,
+			"path":       logging.RedactQuery(r.URL),
+			"status":     sw.status,
+			"latency_ms": float64(latency) / float64(time.Millisecond),
+			"client_ip":  ah.clientIP(r),
+			"user_agent": r.UserAgent(),
+		}).Info("request")
+	}
+}
+
+// metadataCarrier carries trace context in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// instrumentUnary does for gRPC calls what instrument does for HTTP
+// requests, the request ID and trace context coming in the metadata
+func instrumentUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := requestID(metadataCarrier(md).Get(requestIDHeader))
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+
+	ctx, span := tracing.StartServer(ctx, metadataCarrier(md), strings.TrimPrefix(info.FullMethod, "/"),
+		semconv.RPCSystemGRPC,
+	)
+	entry := requestLogger(ctx, id)
+
+	resp, err := handler(logging.NewContext(ctx, entry), req)
+
+	code := status.Code(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	accessLog.WithFields(entry.Data).WithFields(log.Fields{
+		"method":     "GRPC",
+		"route":      info.FullMethod,
+		"status":     code.String(),
+		"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		"client_ip":  grpcDevice(ctx).IP,
+	}).Info("request")
+	return resp, err
+}
@@ -0,0 +1,93 @@
+// Package metrics holds the Prometheus metrics of the auth server
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "auth"
+
+var (
+	// Requests counts HTTP requests by method, route pattern and status
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	// RequestDuration observes how long HTTP requests take
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// Signups counts registered users
+	Signups = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signups_total",
+		Help:      "Users registered.",
+	})
+
+	// TokensIssued counts JWTs issued to users
+	TokensIssued = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "Tokens issued.",
+	})
+
+	// FailedLogins counts refused logins by reason
+	FailedLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failed_logins_total",
+		Help:      "Failed logins by reason.",
+	}, []string{"reason"})
+
+	// HashDuration observes bcrypt, op being create or compare
+	HashDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "password_hash_duration_seconds",
+		Help:      "Password hashing latency by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 8),
+	}, []string{"op"})
+
+	// HashQueueWait observes how long password hashing waits for a worker
+	HashQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "password_hash_queue_wait_seconds",
+		Help:      "Time password hashing waited for a worker by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"op"})
+
+	// HashRejected counts password hashing refused with the queue full
+	HashRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "password_hash_rejected_total",
+		Help:      "Password hashing refused because the queue was full, by operation.",
+	}, []string{"op"})
+
+	// HashQueued is how many password hashes wait for a worker
+	HashQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "password_hash_queued",
+		Help:      "Password hashes waiting for a worker.",
+	})
+
+	// StorageDuration observes storage calls by operation
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_duration_seconds",
+		Help:      "Storage call latency by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"op"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
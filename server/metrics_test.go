@@ -0,0 +1,50 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	for _, path := range []string{"/login/magic", "/admin/users/4f1c6b1e"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("could not execute request: %s", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("could not execute request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read response: %s", err)
+	}
+
+	tt := []struct {
+		label  string
+		metric string
+	}{
+		{"route request", `auth_http_requests_total{method="GET",route="/login/magic",status="200"}`},
+		{"route pattern", `auth_http_requests_total{method="GET",route="/admin/users/:id",status="401"}`},
+		{"route latency", `auth_http_request_duration_seconds_count{method="GET",route="/login/magic",status="200"}`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if !strings.Contains(string(b), tc.metric) {
+				t.Errorf("expected metrics to have %s", tc.metric)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"html"
+	"net/http"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/betalotest/auth/server/validation"
+)
+
+// getPasswordHandler render a template for changing the user password
+func (th *tmplHandler) getPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	if err := th.ExecuteTemplate(w, "password_form.tmpl", formData(r, nil)); err != nil {
+		logger(r.Context()).Warnf("could not execute password tmpl for get request: %s", err)
+		renderError(w, r, th.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+	}
+}
+
+// postPasswordHandler parse the password form, authenticate the user
+// with the current password and store the new one. This is also how
+// users clear a password reset required by an admin
+func (ah *accessHandler) postPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		logger(r.Context()).Warnf("could not parse password form: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	// get form values
+	data := map[string]string{
+		"email":            html.EscapeString(r.Form.Get("email")),
+		"password":         html.EscapeString(r.Form.Get("password")),
+		"newPassword":      html.EscapeString(r.Form.Get("new_password")),
+		"newPasswordCheck": html.EscapeString(r.Form.Get("new_password_check")),
+	}
+
+	for k, v := range data {
+		if v == "" {
+			logger(r.Context()).Warnf("%s is empty", k)
+			renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+				Code:        http.StatusBadRequest,
+				Description: "Bad Request",
+				Cause:       "missing form data",
+			})
+			return
+		}
+	}
+
+	// check if the new passwords match with each other
+	if err := validation.ValidatePassword(data["newPassword"], data["newPasswordCheck"]); err != nil {
+		logger(r.Context()).Warnf("could not validate new password: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid new password",
+		})
+		return
+	}
+
+	user, rerr := ah.authenticate(r.Context(), data["email"], data["password"], ah.device(r))
+	if rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	passwordHash, err := validation.CreatePasswordHash(r.Context(), data["newPassword"])
+	if err != nil {
+		logger(r.Context()).Warnf("could not create password hash: %s", err)
+		if rerr := hashUnavailable(err); rerr != nil {
+			renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+			return
+		}
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	if err := ah.UpdatePassword(r.Context(), user.ID, passwordHash); err != nil {
+		logger(r.Context()).Warnf("could not update password for user %s: %s", user.Email, err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	logger(r.Context()).Infof("password changed for user %s", user.Email)
+	ah.audit(r.Context(), access.AuditEvent{Action: access.AuditPasswordChanged, Actor: user.ID, Target: user.ID}, ah.device(r))
+	ah.notify(r.Context(), access.WebhookPasswordChanged, access.NewUserData(user))
+
+	resp := struct {
+		Msg string
+	}{
+		"password changed",
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := ah.ExecuteTemplate(w, "signup_success.tmpl", resp); err != nil {
+		logger(r.Context()).Warnf("could not execute success tmpl for post password request: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGetPasswordHandler(t *testing.T) {
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/password")
+	if err != nil {
+		t.Errorf("could not execute GET request: %s", err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("expected status 200; got %d", resp.StatusCode)
+	}
+}
+
+func TestPostPasswordHandler(t *testing.T) {
+	tt := []struct {
+		label            string
+		email            string
+		password         string
+		newPassword      string
+		newPasswordCheck string
+		cause            string
+		statusCode       int
+	}{
+		{"empty email", "", "foobar321", "foobar123", "foobar123", "missing form data", 400},
+		{"empty password", "xablau@xmail.com", "", "foobar123", "foobar123", "missing form data", 400},
+		{"empty new password", "xablau@xmail.com", "foobar321", "", "foobar123", "missing form data", 400},
+		{"invalid email", "xablau@xmail,com", "foobar321", "foobar123", "foobar123", "invalid email", 400},
+		{"invalid new password comparison", "xablau@xmail.com", "foobar321", "foobar123", "foobar321", "invalid new password", 400},
+		{"invalid new password length", "xablau@xmail.com", "foobar321", "fuu", "fuu", "invalid new password", 400},
+	}
+
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("email", tc.email)
+			form.Add("password", tc.password)
+			form.Add("new_password", tc.newPassword)
+			form.Add("new_password_check", tc.newPasswordCheck)
+
+			req, err := http.NewRequest("POST", srv.URL+"/password", strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatalf("could not create post request: %s", err)
+			}
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(req)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute post resquest: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+
+			var b bytes.Buffer
+			if _, err := io.Copy(&b, resp.Body); err != nil {
+				t.Errorf("failed to copy response body: %s", err)
+			}
+
+			if !strings.Contains(b.String(), tc.cause) {
+				t.Errorf("expected error message to have cause %s; got %s",
+					tc.cause, b.String())
+			}
+		})
+	}
+}
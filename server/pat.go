@@ -0,0 +1,228 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// maxTokenName is the longest personal access token name
+const maxTokenName = 64
+
+// createdTokenResponse is a newly created personal access
+// token, the only time its secret is shown
+type createdTokenResponse struct {
+	Token string `json:"token"`
+	access.PersonalToken
+}
+
+// getPersonalTokensHandler lists the personal access tokens of the caller
+func (ah *accessHandler) getPersonalTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if rerr := rejectPersonalToken(bearerToken(r)); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	c := claimFromContext(r.Context())
+
+	tokens, err := ah.ListPersonalTokens(r.Context(), c.Subject)
+	if err != nil {
+		logger(r.Context()).Warnf("could not list personal tokens for user %s: %s", c.Subject, err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	if wantsJSON(r) {
+		renderJSON(w, http.StatusOK, struct {
+			Tokens []access.PersonalToken `json:"tokens"`
+		}{tokens})
+		return
+	}
+
+	// the form offers every permission the caller has as scope
+	data := struct {
+		Tokens []access.PersonalToken
+		Scopes []string
+	}{tokens, c.Permissions}
+
+	w.WriteHeader(http.StatusOK)
+	if err := ah.ExecuteTemplate(w, "tokens.tmpl", formData(r, data)); err != nil {
+		logger(r.Context()).Warnf("could not execute tokens tmpl: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+	}
+}
+
+// postPersonalTokenHandler creates a personal access token for the
+// caller from the name, scopes and optional expires_in_days form values
+func (ah *accessHandler) postPersonalTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if rerr := rejectPersonalToken(bearerToken(r)); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		logger(r.Context()).Warnf("could not parse personal token form: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid form data",
+		})
+		return
+	}
+
+	c := claimFromContext(r.Context())
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	if name == "" || len(name) > maxTokenName {
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid name",
+		})
+		return
+	}
+
+	// scopes may be repeated, comma separated or both
+	scopes := []string{}
+	for _, v := range r.Form["scopes"] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+
+	if err := access.ValidatePermissions(scopes); err != nil || !grants(c, scopes) {
+		logger(r.Context()).Warnf("user %s asked for invalid scopes %v", c.Subject, scopes)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid scopes",
+		})
+		return
+	}
+
+	var expiresAt int64
+	if v := r.Form.Get("expires_in_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+				Code:        http.StatusBadRequest,
+				Description: "Bad Request",
+				Cause:       "invalid expires_in_days",
+			})
+			return
+		}
+		expiresAt = time.Now().AddDate(0, 0, days).Unix()
+	}
+
+	user, err := ah.FindUserByID(r.Context(), c.Subject)
+	if err != nil {
+		logger(r.Context()).Warnf("could not find user %s: %s", c.Subject, err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusNotFound,
+			Description: "Not Found",
+		})
+		return
+	}
+
+	secret, t, err := ah.NewPersonalToken(r.Context(), user, name, scopes, expiresAt)
+	if err != nil {
+		logger(r.Context()).Warnf("could not create personal token for user %s: %s", user.Email, err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	logger(r.Context()).Infof("personal token %s created for user %s", t.ID, user.Email)
+	ah.audit(r.Context(), access.AuditEvent{Action: access.AuditPATCreated, Actor: user.ID, Target: t.ID, Detail: name}, ah.device(r))
+
+	resp := createdTokenResponse{secret, t}
+	if wantsJSON(r) {
+		renderJSON(w, http.StatusCreated, resp)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := ah.ExecuteTemplate(w, "token_created.tmpl", resp); err != nil {
+		logger(r.Context()).Warnf("could not execute token created tmpl: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+	}
+}
+
+// postRevokePersonalTokenHandler deletes a personal access token of the caller
+func (ah *accessHandler) postRevokePersonalTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if rerr := rejectPersonalToken(bearerToken(r)); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	c := claimFromContext(r.Context())
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	if err := ah.RevokePersonalToken(r.Context(), c.Subject, id); err != nil {
+		if errors.Cause(err) == mgo.ErrNotFound {
+			renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+				Code:        http.StatusNotFound,
+				Description: "Not Found",
+			})
+			return
+		}
+
+		logger(r.Context()).Warnf("could not revoke personal token %s for user %s: %s", id, c.Subject, err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	logger(r.Context()).Infof("personal token %s revoked for user %s", id, c.Subject)
+	ah.audit(r.Context(), access.AuditEvent{Action: access.AuditPATRevoked, Actor: c.Subject, Target: id}, ah.device(r))
+
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/me/tokens", http.StatusSeeOther)
+}
+
+// rejectPersonalToken keeps personal access tokens from being traded
+// for unscoped tokens or managing personal access tokens and sessions
+func rejectPersonalToken(ss string) *responseError {
+	if !access.IsPersonalToken(ss) {
+		return nil
+	}
+	return &responseError{
+		Code:        http.StatusForbidden,
+		Description: "Forbidden",
+		Cause:       "personal access token not allowed",
+	}
+}
+
+// grants checks that the claims grant every one of perms
+func grants(c *access.Claim, perms []string) bool {
+	for _, p := range perms {
+		if !c.HasPermission(p) {
+			return false
+		}
+	}
+	return true
+}
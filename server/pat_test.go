@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/betalotest/auth/server/access"
+)
+
+func TestPostPersonalTokenHandler(t *testing.T) {
+	tt := []struct {
+		label      string
+		auth       string
+		form       url.Values
+		cause      string
+		statusCode int
+	}{
+		{"personal token", "Bearer pat_xablau", url.Values{"name": {"ci"}}, "personal access token not allowed", 403},
+		{"missing name", "", url.Values{}, "invalid name", 400},
+		{"long name", "", url.Values{"name": {strings.Repeat("x", maxTokenName+1)}}, "invalid name", 400},
+		{"unknown scope", "", url.Values{"name": {"ci"}, "scopes": {"xablau"}}, "invalid scopes", 400},
+		{"ungranted scope", "", url.Values{"name": {"ci"}, "scopes": {"users:read,users:write"}}, "invalid scopes", 400},
+		{"invalid expiry", "", url.Values{"name": {"ci"}, "scopes": {"users:read"}, "expires_in_days": {"0"}}, "invalid expires_in_days", 400},
+	}
+
+	ah := &accessHandler{acc, &tmplHandler{tmpl}, conf}
+
+	// what requireLogin leaves for a user allowed to read users
+	c := &access.Claim{Permissions: []string{access.PermUsersRead}}
+	c.Subject = "4f1c6b1e"
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/me/tokens", strings.NewReader(tc.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", "application/json")
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), claimKey, c))
+
+			w := httptest.NewRecorder()
+			ah.postPersonalTokenHandler(w, r)
+
+			if w.Code != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, w.Code)
+			}
+
+			if !strings.Contains(w.Body.String(), tc.cause) {
+				t.Errorf("expected response to have cause %s; got %s", tc.cause, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPersonalTokenRoutes(t *testing.T) {
+	tt := []struct {
+		label  string
+		method string
+		path   string
+	}{
+		{"list", "GET", "/me/tokens"},
+		{"create", "POST", "/me/tokens"},
+		{"revoke", "POST", "/me/tokens/9b2e7c4a/revoke"},
+	}
+
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+			if err != nil {
+				t.Fatalf("could not create request: %s", err)
+			}
+			req.Header.Set("Accept", "application/json")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute request: %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("expected status code 401; got %d", resp.StatusCode)
+			}
+		})
+	}
+}
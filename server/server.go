@@ -1,18 +1,38 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"html/template"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/betalotest/auth/server/access"
+	"github.com/betalotest/auth/server/logging"
+	"github.com/betalotest/auth/server/metrics"
+	"github.com/betalotest/auth/server/tracing"
+	"github.com/betalotest/auth/server/validation"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 type responseError struct {
-	Code        int
-	Description string
-	Cause       string
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+	Cause       string `json:"cause,omitempty"`
+
+	// RetryAfter, when set, is sent in the Retry-After header
+	RetryAfter time.Duration `json:"-"`
 }
 
 // accessHandler implements the handler interface
@@ -20,50 +40,300 @@ type responseError struct {
 type accessHandler struct {
 	*access.Access
 	*tmplHandler
+	conf *config
 }
 
 type tmplHandler struct {
 	*template.Template
 }
 
-// Serve triggers the server initialization
-func Serve(configfile string) {
-	acc, err := access.New(configfile)
+// Serve runs the HTTP and gRPC servers until SIGINT or SIGTERM, then
+// drains in-flight requests and closes the db session. It returns the
+// error that stopped the servers, if any
+func Serve(configfile string) error {
+	// keep passwords and tokens out of the logs
+	log.AddHook(logging.RedactHook{})
+
+	conf, err := loadConfig(configfile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server configuration")
+	}
+
+	if err := validation.SetHashLimits(conf.hashConcurrency, conf.hashQueueDepth); err != nil {
+		return errors.Wrap(err, "could not limit password hashing")
+	}
+
+	stopTracing, err := tracing.Setup(conf.tracing)
+	if err != nil {
+		return errors.Wrap(err, "could not set up tracing")
+	}
+
+	acc, err := connect(configfile, conf.dbConnectRetry)
+	if err != nil {
+		return errors.Wrap(err, "could not get access")
+	}
+	defer acc.Close()
+
+	tmpl, err := template.ParseGlob("templates/*")
+	if err != nil {
+		return errors.Wrap(err, "could not parse templates")
+	}
+
+	lis, err := net.Listen("tcp", conf.grpcAddress)
 	if err != nil {
-		log.Fatalf("failed to get access: %s", err)
+		return errors.Wrap(err, "could not listen on "+conf.grpcAddress)
 	}
 
-	tmpl := template.Must(template.ParseGlob("templates/*"))
+	gs := grpcEngine(acc, conf)
+	servers := []*grpc.Server{gs}
 
-	engine := serverEngine(acc, tmpl)
+	var extAuthzLis net.Listener
+	if conf.extAuthzAddress != "" {
+		extAuthzLis, err = net.Listen("tcp", conf.extAuthzAddress)
+		if err != nil {
+			return errors.Wrap(err, "could not listen on "+conf.extAuthzAddress)
+		}
+		servers = append(servers, extAuthzEngine(acc, conf))
+	}
+
+	hs := &http.Server{
+		Addr:           conf.httpAddress,
+		Handler:        serverEngine(acc, tmpl, conf),
+		ReadTimeout:    conf.httpReadTimeout,
+		WriteTimeout:   conf.httpWriteTimeout,
+		IdleTimeout:    conf.httpIdleTimeout,
+		MaxHeaderBytes: conf.httpMaxHeaderBytes,
+	}
+
+	errc := make(chan error, len(servers)+1)
+	go func() {
+		log.Infof("starting grpc server on %s", conf.grpcAddress)
+		errc <- errors.Wrap(gs.Serve(lis), "grpc server failed")
+	}()
+	if extAuthzLis != nil {
+		go func() {
+			log.Infof("starting ext_authz server on %s", conf.extAuthzAddress)
+			errc <- errors.Wrap(servers[1].Serve(extAuthzLis), "ext_authz server failed")
+		}()
+	}
+	go func() {
+		if conf.tls == nil {
+			log.Infof("starting server on %s", conf.httpAddress)
+			errc <- errors.Wrap(hs.ListenAndServe(), "http server failed")
+			return
+		}
+
+		// the certificate comes from the GetCertificate of conf.tls
+		hs.TLSConfig = conf.tls
+		log.Infof("starting tls server on %s", conf.httpAddress)
+		errc <- errors.Wrap(hs.ListenAndServeTLS("", ""), "https server failed")
+	}()
+
+	stop := make(chan struct{})
+	sendCtx, cancelSends := context.WithCancel(context.Background())
+	defer cancelSends()
+
+	var wg sync.WaitGroup
+	if len(acc.Webhooks) > 0 {
+		log.Infof("sending webhooks to %d subscriptions", len(acc.Webhooks))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newWebhookDispatcher(acc).run(sendCtx, stop)
+		}()
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case sig := <-sigc:
+		log.Infof("received %s, shutting down", sig)
+	case err = <-errc:
+		log.Errorf("%s, shutting down", err)
+	}
 
-	log.Info("starting server on port :3000")
-	if err := http.ListenAndServe(":3000", engine); err != nil {
-		log.Fatalf("failed to start server on :3000: %s", err)
+	ctx, cancel := context.WithTimeout(context.Background(), conf.shutdownTimeout)
+	defer cancel()
+
+	// webhooks in flight get what is left of shutdown_timeout
+	go func() {
+		<-ctx.Done()
+		cancelSends()
+	}()
+
+	close(stop)
+	shutdown(ctx, hs, servers...)
+	wg.Wait()
+
+	if err := stopTracing(ctx); err != nil {
+		log.Errorf("could not flush spans: %s", err)
 	}
+
+	log.Info("server stopped")
+	return err
 }
 
-func serverEngine(a *access.Access, t *template.Template) *httprouter.Router {
-	th := &tmplHandler{t}       // allow us to pass templates to handlers
-	ah := &accessHandler{a, th} // allow us to pass access data and templates
+// shutdown stops accepting connections and waits for in-flight
+// requests until ctx is done, then closes the remaining ones
+func shutdown(ctx context.Context, hs *http.Server, servers ...*grpc.Server) {
+	if err := hs.Shutdown(ctx); err != nil {
+		logger(ctx).Errorf("could not drain http requests: %s", err)
+		hs.Close()
+	}
+
+	for _, gs := range servers {
+		done := make(chan struct{})
+		go func(gs *grpc.Server) {
+			gs.GracefulStop()
+			close(done)
+		}(gs)
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			logger(ctx).Errorf("could not drain grpc requests: %s", ctx.Err())
+			gs.Stop()
+		}
+	}
+}
+
+func serverEngine(a *access.Access, t *template.Template, conf *config) *httprouter.Router {
+	th := &tmplHandler{t}             // allow us to pass templates to handlers
+	ah := &accessHandler{a, th, conf} // allow us to pass access data, templates and settings
 
-	r := httprouter.New()
+	r := instrumentedRouter{httprouter.New(), ah}
 
 	// Register user
-	r.HandlerFunc("GET", "/signup", th.getSignupHandler)
-	r.HandlerFunc("POST", "/signup", ah.postSignupHandler)
+	r.HandlerFunc("GET", "/signup", ah.csrf(ah.getSignupHandler))
+	r.HandlerFunc("POST", "/signup", ah.csrf(ah.postSignupHandler))
 
 	// Request new token
-	r.HandlerFunc("GET", "/token", th.getTokenHandler)
-	r.HandlerFunc("POST", "/token", ah.postTokenHandler)
-	return r
+	r.HandlerFunc("GET", "/token", ah.csrf(th.getTokenHandler))
+	r.HandlerFunc("POST", "/token", ah.csrf(ah.postTokenHandler))
+	r.HandlerFunc("POST", "/token/certificate", ah.postCertificateTokenHandler)
+	r.HandlerFunc("POST", "/token/refresh", ah.requireToken(ah.postRefreshHandler))
+	r.HandlerFunc("POST", "/token/revoke", ah.requireToken(ah.postRevokeHandler))
+
+	// Passwordless login by email
+	r.HandlerFunc("GET", "/login/magic", ah.csrf(th.getMagicLinkHandler))
+	r.HandlerFunc("POST", "/login/magic", ah.csrf(ah.postMagicLinkHandler))
+	r.HandlerFunc("GET", "/login/magic/confirm", ah.csrf(th.getMagicLinkConfirmHandler))
+	r.HandlerFunc("POST", "/login/magic/confirm", ah.csrf(ah.postMagicLinkConfirmHandler))
+
+	// End browser session
+	r.HandlerFunc("POST", "/logout", ah.csrf(ah.postLogoutHandler))
+
+	// Browser sessions and tokens of the caller
+	r.HandlerFunc("GET", "/me/sessions", ah.csrf(ah.requireLogin(ah.getSessionsHandler)))
+	r.HandlerFunc("POST", "/me/sessions/:id/revoke", ah.csrf(ah.requireLogin(ah.postRevokeSessionHandler)))
+	r.HandlerFunc("POST", "/me/signout-everywhere", ah.csrf(ah.requireLogin(ah.postSignoutEverywhereHandler)))
+
+	// Personal access tokens of the caller
+	r.HandlerFunc("GET", "/me/tokens", ah.csrf(ah.requireLogin(ah.getPersonalTokensHandler)))
+	r.HandlerFunc("POST", "/me/tokens", ah.csrf(ah.requireLogin(ah.postPersonalTokenHandler)))
+	r.HandlerFunc("POST", "/me/tokens/:id/revoke", ah.csrf(ah.requireLogin(ah.postRevokePersonalTokenHandler)))
+
+	// Token introspection for downstream services
+	r.HandlerFunc("POST", "/introspect", ah.postIntrospectHandler)
+
+	// Forward auth for reverse proxies
+	r.HandlerFunc("GET", "/auth/verify", ah.getVerifyHandler)
+	r.HandlerFunc("HEAD", "/auth/verify", ah.getVerifyHandler)
+
+	// Change password
+	r.HandlerFunc("GET", "/password", ah.csrf(th.getPasswordHandler))
+	r.HandlerFunc("POST", "/password", ah.csrf(ah.postPasswordHandler))
+
+	// Admin
+	read := func(h http.HandlerFunc) http.HandlerFunc { return ah.requirePermission(access.PermUsersRead, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return ah.requirePermission(access.PermUsersWrite, h) }
+
+	r.HandlerFunc("GET", "/admin/users", read(ah.listUsersHandler))
+	r.HandlerFunc("GET", "/admin/users/:id", read(ah.getUserHandler))
+	r.HandlerFunc("DELETE", "/admin/users/:id", write(ah.userActionHandler(access.AuditUserDelete, func(ctx context.Context, id string) error {
+		return ah.DeleteUser(ctx, id)
+	})))
+	r.HandlerFunc("POST", "/admin/users/:id/disable", write(ah.userActionHandler(access.AuditUserDisable, func(ctx context.Context, id string) error {
+		return ah.SetDisabled(ctx, id, true)
+	})))
+	r.HandlerFunc("POST", "/admin/users/:id/enable", write(ah.userActionHandler(access.AuditUserEnable, func(ctx context.Context, id string) error {
+		return ah.SetDisabled(ctx, id, false)
+	})))
+	r.HandlerFunc("POST", "/admin/users/:id/reset-password", write(ah.userActionHandler(access.AuditUserResetPassword, func(ctx context.Context, id string) error {
+		return ah.RequirePasswordReset(ctx, id)
+	})))
+	r.HandlerFunc("POST", "/admin/users/:id/revoke-tokens", write(ah.userActionHandler(access.AuditUserRevokeTokens, func(ctx context.Context, id string) error {
+		return ah.RevokeTokens(ctx, id)
+	})))
+	r.HandlerFunc("POST", "/admin/users/:id/unlock", write(ah.userActionHandler(access.AuditUserUnlock, func(ctx context.Context, id string) error {
+		return ah.Unlock(ctx, id)
+	})))
+	r.HandlerFunc("PUT", "/admin/users/:id/roles",
+		ah.requirePermission(access.PermRolesWrite, ah.putUserRolesHandler))
+
+	// Security events
+	r.HandlerFunc("GET", "/admin/audit", ah.requirePermission(access.PermAuditRead, ah.getAuditHandler))
+
+	// Invites for invite only signup
+	r.HandlerFunc("GET", "/admin/invites", read(ah.listInvitesHandler))
+	r.HandlerFunc("POST", "/admin/invites", write(ah.postInviteHandler))
+	r.HandlerFunc("DELETE", "/admin/invites/:id", write(ah.deleteInviteHandler))
+
+	// Webhook delivery log
+	r.HandlerFunc("GET", "/admin/webhooks/deliveries", read(ah.listDeliveriesHandler))
+	r.HandlerFunc("POST", "/admin/webhooks/deliveries/:id/retry", write(ah.postRetryDeliveryHandler))
+
+	// Prometheus metrics and probes, left out of the request metrics
+	r.Router.Handler("GET", "/metrics", metrics.Handler())
+	r.Router.HandlerFunc("GET", "/healthz", getHealthzHandler)
+	r.Router.HandlerFunc("GET", "/readyz", ah.getReadyzHandler)
+	return r.Router
 }
 
-func renderError(w http.ResponseWriter, t *template.Template, rerr responseError) {
+// renderError renders rerr with the error template,
+// or as JSON for requests accepting it
+func renderError(w http.ResponseWriter, r *http.Request, t *template.Template, rerr responseError) {
+	if wantsJSON(r) {
+		renderJSONError(w, rerr)
+		return
+	}
+
+	setRetryAfter(w, rerr)
 	w.WriteHeader(rerr.Code)
 	if err := t.ExecuteTemplate(w, "error.tmpl", rerr); err != nil {
-		log.Errorf("could not execute not found template: %s", err)
+		logger(r.Context()).Errorf("could not execute not found template: %s", err)
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("404 - Not Found"))
 	}
 }
+
+// renderJSON writes v as the JSON body of the response
+func renderJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("could not encode json response: %s", err)
+	}
+}
+
+// renderJSONError is the renderError counterpart for API endpoints
+func renderJSONError(w http.ResponseWriter, rerr responseError) {
+	setRetryAfter(w, rerr)
+	renderJSON(w, rerr.Code, rerr)
+}
+
+// setRetryAfter sets the Retry-After header of rerr, in whole seconds
+func setRetryAfter(w http.ResponseWriter, rerr responseError) {
+	if rerr.RetryAfter > 0 {
+		secs := int(math.Ceil(rerr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+}
+
+// wantsJSON checks if the client asked for JSON instead of HTML,
+// letting API clients use the same endpoints as the HTML forms
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -1,15 +1,76 @@
 package server
 
 import (
+	"context"
 	"html/template"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
 
+	"github.com/betalotest/auth/server/access"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 var tmpl *template.Template
 
+// acc is enough to sign and parse tokens, it has no db conn
+var acc = &access.Access{Signature: "foobar", Issuer: "tester"}
+
+// conf has the default server settings
+var conf = &config{grpcAddress: ":3001", cookieSecure: true, cookieSameSite: http.SameSiteLaxMode, signupMode: signupOpen}
+
 func init() {
 	log.SetOutput(ioutil.Discard)
+	accessLog.SetOutput(ioutil.Discard)
 	tmpl = template.Must(template.ParseGlob("../templates/*"))
 }
+
+// addCSRF makes req pass the csrf checks of the form endpoints
+func addCSRF(req *http.Request) {
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: "xablau"})
+	req.Header.Set(csrfHeader, "xablau")
+}
+
+func TestShutdown(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	started := make(chan struct{})
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go hs.Serve(lis)
+
+	gs := grpc.NewServer()
+
+	respc := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + lis.Addr().String())
+		if err != nil {
+			t.Errorf("expected in-flight request to finish; got '%s'", err)
+		}
+		respc <- resp
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown(ctx, hs, gs)
+
+	resp := <-respc
+	if resp == nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected in-flight request to get status code 204; got %v", resp)
+	}
+	resp.Body.Close()
+
+	if _, err := http.Get("http://" + lis.Addr().String()); err == nil {
+		t.Error("expected new requests to be refused after shutdown")
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/betalotest/auth/server/access"
+)
+
+// sessionCookie is the name of the browser session cookie
+const sessionCookie = "auth_session"
+
+// startSession logs the user in the browser, replacing any session the
+// request already carries so a planted session ID can't be reused
+func (ah *accessHandler) startSession(w http.ResponseWriter, r *http.Request, user access.User) *responseError {
+	if rerr := checkPasswordReset(r.Context(), user); rerr != nil {
+		return rerr
+	}
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := ah.DeleteSession(r.Context(), c.Value); err != nil {
+			logger(r.Context()).Warnf("could not delete previous session for user %s: %s", user.Email, err)
+		}
+	}
+
+	secret, err := ah.NewSession(r.Context(), user.ID, ah.device(r))
+	if err != nil {
+		logger(r.Context()).Warnf("could not create session for user %s: %s", user.Email, err)
+		return &responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		}
+	}
+
+	ah.setSessionCookie(w, secret, int(ah.SessionMaxAge.Seconds()))
+
+	if err := ah.rotateCSRF(w, r); err != nil {
+		logger(r.Context()).Errorf("could not rotate csrf token for user %s: %s", user.Email, err)
+	}
+
+	logger(r.Context()).Infof("new session started for user %s", user.Email)
+	return nil
+}
+
+// postLogoutHandler ends the session of the browser and clears its cookie
+func (ah *accessHandler) postLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := ah.DeleteSession(r.Context(), c.Value); err != nil {
+			logger(r.Context()).Warnf("could not delete session: %s", err)
+			renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+				Code:        http.StatusInternalServerError,
+				Description: "Internal Server Error",
+			})
+			return
+		}
+	}
+
+	ah.setSessionCookie(w, "", -1)
+
+	if err := ah.rotateCSRF(w, r); err != nil {
+		logger(r.Context()).Errorf("could not rotate csrf token: %s", err)
+	}
+
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/token", http.StatusSeeOther)
+}
+
+// sessionUser returns the session the request carries and its owner
+func (ah *accessHandler) sessionUser(r *http.Request) (access.User, access.Session, *responseError) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return access.User{}, access.Session{}, &responseError{
+			Code:        http.StatusUnauthorized,
+			Description: "Unauthorized",
+			Cause:       "missing session",
+		}
+	}
+
+	u, s, err := ah.SessionUser(r.Context(), c.Value)
+	if err != nil {
+		logger(r.Context()).Warnf("could not verify session: %s", err)
+		return access.User{}, access.Session{}, &responseError{
+			Code:        http.StatusUnauthorized,
+			Description: "Unauthorized",
+			Cause:       "invalid session",
+		}
+	}
+	return u, s, nil
+}
+
+// device describes the client of the request, its IP is taken from
+// the client_ip_header set by the reverse proxy, when configured
+func (ah *accessHandler) device(r *http.Request) access.Device {
+	d := access.Device{UserAgent: r.UserAgent()}
+
+	if cert := ah.clientCert(r); cert != nil {
+		d.CertThumbprint = access.CertThumbprint(cert.Raw)
+	}
+
+	d.IP = ah.clientIP(r)
+	return d
+}
+
+// fromTrustedProxy checks if the request comes straight from one of trusted_proxies
+func (ah *accessHandler) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return ah.trustedProxy(net.ParseIP(host))
+}
+
+// trustedProxy checks if ip is one of trusted_proxies
+func (ah *accessHandler) trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range ah.conf.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client, the remote address unless the
+// request comes from one of trusted_proxies with clientIPHeader. Proxies
+// append the address they got the request from, so the client is the
+// rightmost one that is not a trusted proxy, anything left of it is
+// whatever the client sent
+func (ah *accessHandler) clientIP(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = ""
+	}
+
+	if ah.conf.clientIPHeader == "" || !ah.fromTrustedProxy(r) {
+		return client
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values(ah.conf.clientIPHeader), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+		if !ah.trustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// setSessionCookie sets the session cookie, a negative maxAge deletes it
+func (ah *accessHandler) setSessionCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   ah.conf.cookieSecure,
+		HttpOnly: true,
+		SameSite: ah.conf.cookieSameSite,
+	})
+}
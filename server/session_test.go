@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostLogoutHandler(t *testing.T) {
+	tt := []struct {
+		label      string
+		accept     string
+		statusCode int
+	}{
+		{"browser", "text/html", 303},
+		{"api", "application/json", 204},
+	}
+
+	// don't follow the redirect to the login form
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req, err := http.NewRequest("POST", srv.URL+"/logout", nil)
+			if err != nil {
+				t.Fatalf("could not create post request: %s", err)
+			}
+			req.Header.Set("Accept", tc.accept)
+			addCSRF(req)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute post request: %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+
+			var c *http.Cookie
+			for _, cookie := range resp.Cookies() {
+				if cookie.Name == sessionCookie {
+					c = cookie
+				}
+			}
+
+			if c == nil {
+				t.Fatalf("expected the %s cookie to be cleared", sessionCookie)
+			}
+
+			if c.MaxAge >= 0 || c.Value != "" {
+				t.Errorf("expected an expired empty cookie; got max age %d and value '%s'", c.MaxAge, c.Value)
+			}
+
+			if !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode {
+				t.Errorf("expected a secure, http only, same site lax cookie; got %v", c)
+			}
+		})
+	}
+}
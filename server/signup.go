@@ -1,19 +1,39 @@
 package server
 
 import (
+	"context"
 	"html"
 	"net/http"
+	"strings"
 
+	"github.com/betalotest/auth/server/access"
+	"github.com/betalotest/auth/server/metrics"
 	"github.com/betalotest/auth/server/validation"
-	log "github.com/sirupsen/logrus"
 )
 
-// getSignupHandler render a template for registering new user
-func (th *tmplHandler) getSignupHandler(w http.ResponseWriter, r *http.Request) {
+// getSignupHandler render a template for registering new user,
+// filled in with the invite code of invite links
+func (ah *accessHandler) getSignupHandler(w http.ResponseWriter, r *http.Request) {
+	if ah.conf.signupMode == signupDisabled {
+		renderError(w, r, ah.Lookup("error.tmpl"), *errSignupDisabled)
+		return
+	}
+
+	data := struct {
+		Invite     string
+		InviteOnly bool
+	}{
+		r.URL.Query().Get("invite"),
+		ah.conf.signupMode == signupInvite,
+	}
+
 	w.WriteHeader(http.StatusOK)
-	if err := th.ExecuteTemplate(w, "signup_form.tmpl", nil); err != nil {
-		log.Warnf("could not execute signup tmpl for get request: %s", err)
-		renderError(w, th.Lookup("error.tpml"), responseError{})
+	if err := ah.ExecuteTemplate(w, "signup_form.tmpl", formData(r, data)); err != nil {
+		logger(r.Context()).Warnf("could not execute signup tmpl for get request: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
 	}
 }
 
@@ -22,8 +42,8 @@ func (ah *accessHandler) postSignupHandler(w http.ResponseWriter, r *http.Reques
 
 	// Try to parse data from signup form
 	if err := r.ParseForm(); err != nil {
-		log.Warnf("could not parse signup form: ", err)
-		renderError(w, ah.Lookup("error.tpml"), responseError{
+		logger(r.Context()).Warnf("could not parse signup form: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
 			Code:        http.StatusInternalServerError,
 			Description: "Internal Server Error",
 		})
@@ -40,8 +60,8 @@ func (ah *accessHandler) postSignupHandler(w http.ResponseWriter, r *http.Reques
 
 	for k, v := range data {
 		if v == "" {
-			log.Warnf("%s is empty", k)
-			renderError(w, ah.Lookup("error.tmpl"), responseError{
+			logger(r.Context()).Warnf("%s is empty", k)
+			renderError(w, r, ah.Lookup("error.tmpl"), responseError{
 				Code:        http.StatusBadRequest,
 				Description: "Bad Request",
 				Cause:       "missing form data",
@@ -50,87 +70,182 @@ func (ah *accessHandler) postSignupHandler(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
+	// only asked for while signup is invite only
+	invite := r.Form.Get("invite")
+
+	u, rerr := ah.register(r.Context(), data["username"], data["email"], data["password"], data["passwordCheck"], invite, ah.device(r))
+	if rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	resp := struct {
+		ID  string `json:"id"`
+		Msg string `json:"msg"`
+	}{
+		u.ID,
+		"user created",
+	}
+
+	if wantsJSON(r) {
+		renderJSON(w, http.StatusCreated, resp)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := ah.ExecuteTemplate(w, "signup_success.tmpl", resp); err != nil {
+		logger(r.Context()).Warnf("could not execute success tmpl for post signup request: %s", err)
+
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+}
+
+// errSignupDisabled is returned for every signup while signup_mode is disabled
+var errSignupDisabled = &responseError{
+	Code:        http.StatusForbidden,
+	Description: "Forbidden",
+	Cause:       "signup disabled",
+}
+
+// register validates the new user details and stores it, redeeming the
+// invite while signup is invite only. It returns the error to render if
+// the user can't sign up from the device d
+func (ah *accessHandler) register(ctx context.Context, name, email, password, passwordCheck, invite string, d access.Device) (access.User, *responseError) {
+	if ah.conf.signupMode == signupDisabled {
+		logger(ctx).Warnf("signup of %s refused, signup is disabled", email)
+		return access.User{}, errSignupDisabled
+	}
+
 	// check if valid username
-	if err := validation.ValidateName(data["username"]); err != nil {
-		log.Warnf("could not validate username: ", err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+	if err := validation.ValidateName(name); err != nil {
+		logger(ctx).Warnf("could not validate username: %s", err)
+		return access.User{}, &responseError{
 			Code:        http.StatusBadRequest,
 			Description: "Bad Request",
 			Cause:       "invalid username",
-		})
-		return
+		}
 	}
 
 	// check if valid email
-	if err := validation.ValidateEmail(data["email"]); err != nil {
-		log.Warnf("could not validate email: ", err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+	if err := validation.ValidateEmail(email); err != nil {
+		logger(ctx).Warnf("could not validate email: %s", err)
+		return access.User{}, &responseError{
 			Code:        http.StatusBadRequest,
 			Description: "Bad Request",
 			Cause:       "invalid email",
-		})
-		return
+		}
+	}
+
+	if ah.conf.signupMode == signupDomain && !ah.allowedDomain(email) {
+		logger(ctx).Warnf("signup of %s refused, email domain not allowed", email)
+		return access.User{}, &responseError{
+			Code:        http.StatusForbidden,
+			Description: "Forbidden",
+			Cause:       "email domain not allowed",
+		}
+	}
+
+	if ah.conf.signupMode == signupInvite && invite == "" {
+		logger(ctx).Warnf("signup of %s refused, missing invite", email)
+		return access.User{}, &responseError{
+			Code:        http.StatusForbidden,
+			Description: "Forbidden",
+			Cause:       "invite required",
+		}
 	}
 
 	// check if provided passwords match with each other
-	if err := validation.ValidatePassword(data["password"], data["passwordCheck"]); err != nil {
-		log.Warnf("could not validate password: %s", err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+	if err := validation.ValidatePassword(password, passwordCheck); err != nil {
+		logger(ctx).Warnf("could not validate password: %s", err)
+		return access.User{}, &responseError{
 			Code:        http.StatusBadRequest,
 			Description: "Bad Request",
 			Cause:       "invalid password",
-		})
-		return
+		}
 	}
 
 	// hash user password before storing it
-	passwordHash, err := validation.CreatePasswordHash(data["password"])
+	passwordHash, err := validation.CreatePasswordHash(ctx, password)
 	if err != nil {
-		log.Warnf("could not create password hash: %s", err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+		logger(ctx).Warnf("could not create password hash: %s", err)
+		if rerr := hashUnavailable(err); rerr != nil {
+			return access.User{}, rerr
+		}
+		return access.User{}, &responseError{
 			Code:        http.StatusInternalServerError,
 			Description: "Internal Server Error",
-		})
-		return
+		}
 	}
 
-	u, _ := ah.FindUserByEmail(data["email"])
+	u, _ := ah.FindUserByEmail(ctx, email)
 	if u.CreatedAt != "" {
-		log.Warnf("user email '%s' is already is use", data["email"])
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+		logger(ctx).Warnf("user email '%s' is already is use", email)
+		return access.User{}, &responseError{
 			Code:        http.StatusBadRequest,
 			Description: "Internal Server Error",
 			Cause:       "email is already in use",
-		})
-		return
+		}
 	}
 
-	if err := ah.RegisterUser(data["username"], data["email"], passwordHash); err != nil {
-		log.Warnf("could not register user %s: %s", data["email"], err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+	// redeemed last, so invalid details don't use up the invite
+	var inv access.Invite
+	if ah.conf.signupMode == signupInvite {
+		if inv, err = ah.RedeemInvite(ctx, invite, email); err != nil {
+			logger(ctx).Warnf("could not redeem invite for %s: %s", email, err)
+			if err != access.ErrInvalidInvite {
+				return access.User{}, &responseError{
+					Code:        http.StatusInternalServerError,
+					Description: "Internal Server Error",
+				}
+			}
+			return access.User{}, &responseError{
+				Code:        http.StatusForbidden,
+				Description: "Forbidden",
+				Cause:       "invalid invite",
+			}
+		}
+	}
+
+	u, err = ah.RegisterUser(ctx, name, email, passwordHash)
+	if err != nil {
+		logger(ctx).Warnf("could not register user %s: %s", email, err)
+		if inv.ID != "" {
+			if err := ah.ReleaseInvite(ctx, inv.ID); err != nil {
+				logger(ctx).Errorf("could not release invite %s: %s", inv.ID, err)
+			}
+		}
+		return access.User{}, &responseError{
 			Code:        http.StatusInternalServerError,
 			Description: "Internal Server Error",
-		})
-		return
+		}
 	}
 
-	log.Infof("new user registed %s", data["email"])
-
-	resp := struct {
-		Msg string
-	}{
-		"user created",
+	e := access.AuditEvent{Action: access.AuditSignup, Actor: u.ID, Target: u.ID}
+	if inv.ID != "" {
+		logger(ctx).Infof("invite %s redeemed by %s", inv.ID, email)
+		e.Detail = "invite " + inv.ID
 	}
+	ah.audit(ctx, e, d)
+	metrics.Signups.Inc()
+	ah.notify(ctx, access.WebhookUserCreated, access.NewUserData(u))
 
-	w.WriteHeader(http.StatusCreated)
-
-	if err := ah.ExecuteTemplate(w, "signup_success.tmpl", resp); err != nil {
-		log.Warnf("could not execute success tmpl for post signup request: %s", err)
+	logger(ctx).Infof("new user registed %s", email)
+	return u, nil
+}
 
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
-			Code:        http.StatusInternalServerError,
-			Description: "Internal Server Error",
-		})
-		return
+// allowedDomain checks the email domain is one of signup_allowed_domains,
+// subdomains have to be listed on their own
+func (ah *accessHandler) allowedDomain(email string) bool {
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, d := range ah.conf.signupDomains {
+		if domain == d {
+			return true
+		}
 	}
+	return false
 }
@@ -2,16 +2,19 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+
+	"github.com/betalotest/auth/server/access"
 )
 
 func TestGetSignupHandler(t *testing.T) {
-	srv := httptest.NewServer(serverEngine(nil, tmpl))
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
 	defer srv.Close()
 
 	t.Run("status 200", func(t *testing.T) {
@@ -45,7 +48,7 @@ func TestPostSignupHandler(t *testing.T) {
 		{"invalid password length", "xablau", "xablau@xmail.com", "fuu", "fuu", "invalid password", 400},
 	}
 
-	srv := httptest.NewServer(serverEngine(nil, tmpl))
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
 	defer srv.Close()
 
 	for _, tc := range tt {
@@ -63,6 +66,7 @@ func TestPostSignupHandler(t *testing.T) {
 			}
 			req.PostForm = form
 			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(req)
 
 			resp, err := client.Do(req)
 			if err != nil {
@@ -86,3 +90,80 @@ func TestPostSignupHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestSignupModes(t *testing.T) {
+	tt := []struct {
+		label  string
+		mode   string
+		email  string
+		invite string
+		cause  string
+	}{
+		{"disabled", signupDisabled, "xablau@xmail.com", "", "signup disabled"},
+		{"disabled with invite", signupDisabled, "xablau@xmail.com", "foobar", "signup disabled"},
+		{"domain not allowed", signupDomain, "xablau@xmail.com", "", "email domain not allowed"},
+		{"subdomain not allowed", signupDomain, "xablau@dev.foomail.com", "", "email domain not allowed"},
+		{"invite missing", signupInvite, "xablau@xmail.com", "", "invite required"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			c := *conf
+			c.signupMode = tc.mode
+			c.signupDomains = []string{"foomail.com"}
+			ah := &accessHandler{acc, &tmplHandler{tmpl}, &c}
+
+			_, rerr := ah.register(context.Background(), "xablau", tc.email, "foobar321", "foobar321", tc.invite, access.Device{})
+			if rerr == nil {
+				t.Fatal("expected signup to be refused")
+			}
+
+			if rerr.Code != http.StatusForbidden || rerr.Cause != tc.cause {
+				t.Errorf("expected 403 '%s'; got %d '%s'", tc.cause, rerr.Code, rerr.Cause)
+			}
+		})
+	}
+
+	t.Run("get form disabled", func(t *testing.T) {
+		c := *conf
+		c.signupMode = signupDisabled
+
+		srv := httptest.NewServer(serverEngine(nil, tmpl, &c))
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL + "/signup")
+		if err != nil {
+			t.Fatalf("could not execute get request: %s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403; got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestAllowedDomain(t *testing.T) {
+	c := *conf
+	c.signupDomains = []string{"foomail.com", "xmail.com"}
+	ah := &accessHandler{acc, nil, &c}
+
+	tt := []struct {
+		email   string
+		allowed bool
+	}{
+		{"gopher@foomail.com", true},
+		{"gopher@XMail.com", true},
+		{"gopher@dev.foomail.com", false},
+		{"gopher@foomail.com.evil.com", false},
+		{"foomail.com@evil.com", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.email, func(t *testing.T) {
+			if allowed := ah.allowedDomain(tc.email); allowed != tc.allowed {
+				t.Errorf("expected allowed %t; got %t", tc.allowed, allowed)
+			}
+		})
+	}
+}
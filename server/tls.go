@@ -0,0 +1,259 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// certCheckInterval limits how often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// tlsVersions maps the tls_min_version values
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadTLSConfig builds the TLS settings shared by the HTTP and gRPC
+// servers, nil when tls_cert_file and tls_key_file are not set.
+// Client certificates are verified against tls_client_ca_file when set
+func loadTLSConfig(v *viper.Viper) (*tls.Config, error) {
+	certFile, keyFile := v.GetString("tls_cert_file"), v.GetString("tls_key_file")
+	if certFile == "" && keyFile == "" {
+		if v.GetString("tls_client_ca_file") != "" && v.GetString("client_cert_header") == "" {
+			return nil, errors.New("tls_client_ca_file needs tls_cert_file and tls_key_file, or client_cert_header")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+
+	minVersion, ok := tlsVersions[v.GetString("tls_min_version")]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls_min_version '%s'", v.GetString("tls_min_version"))
+	}
+
+	suites, err := cipherSuites(v.GetStringSlice("tls_cipher_suites"))
+	if err != nil {
+		return nil, err
+	}
+
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+		GetCertificate: cr.GetCertificate,
+	}
+
+	c.ClientCAs, err = loadClientCAs(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.ClientCAs != nil {
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if v.GetBool("tls_client_cert_required") {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return c, nil
+}
+
+// loadClientCAs reads the CAs client certificates are verified
+// against from tls_client_ca_file, nil when it is not set
+func loadClientCAs(v *viper.Viper) (*x509.CertPool, error) {
+	caFile := v.GetString("tls_client_ca_file")
+	if caFile == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read tls_client_ca_file")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates in tls_client_ca_file " + caFile)
+	}
+	return pool, nil
+}
+
+// cipherSuites maps the tls_cipher_suites names, nil keeps the
+// Go defaults. They only apply to TLS 1.2, 1.3 suites are fixed
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	var ids []uint16
+	for _, n := range names {
+		id, ok := known[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure tls cipher suite '%s'", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// certReloader serves the certificate of its files, loading
+// them again once they change, so renewed certificates are
+// picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// modified returns when the certificate or key file last changed
+func (cr *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "could not stat "+f)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) load() error {
+	mod, err := cr.modified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load tls certificate")
+	}
+
+	cr.cert, cr.modTime = &cert, mod
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloaded when its
+// files changed. A failed reload keeps the previous certificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if now := time.Now(); now.Sub(cr.checked) >= certCheckInterval {
+		cr.checked = now
+		if mod, err := cr.modified(); err == nil && !mod.Equal(cr.modTime) {
+			if err := cr.load(); err != nil {
+				log.Errorf("could not reload tls certificate, keeping the current one: %s", err)
+			} else {
+				log.Infof("tls certificate reloaded from %s", cr.certFile)
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// clientCert returns the verified client certificate of the request, from
+// the TLS connection or, behind a proxy terminating TLS, from the URL
+// escaped PEM the proxy puts in client_cert_header. The header is only
+// read on plain connections from trusted_proxies, and its certificate
+// must chain to tls_client_ca_file for client authentication
+func (ah *accessHandler) clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS != nil {
+		if len(r.TLS.VerifiedChains) > 0 {
+			return r.TLS.VerifiedChains[0][0]
+		}
+		return nil
+	}
+
+	if ah.conf.clientCertHeader == "" || ah.conf.clientCAs == nil || !ah.fromTrustedProxy(r) {
+		return nil
+	}
+
+	cert := parseEscapedCert(r.Header.Get(ah.conf.clientCertHeader))
+	if cert == nil {
+		return nil
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:     ah.conf.clientCAs,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		logger(r.Context()).Warnf("could not verify client certificate %s: %s", cert.Subject, err)
+		return nil
+	}
+	return cert
+}
+
+// parseEscapedCert parses a URL escaped PEM certificate, like nginx
+// $ssl_client_escaped_cert or the Envoy source certificate. Returns
+// nil when there is none or it is malformed
+func parseEscapedCert(s string) *x509.Certificate {
+	if s == "" {
+		return nil
+	}
+
+	b, err := url.PathUnescape(s)
+	if err != nil {
+		log.Warnf("could not unescape client certificate: %s", err)
+		return nil
+	}
+
+	block, _ := pem.Decode([]byte(b))
+	if block == nil {
+		log.Warn("could not decode client certificate pem")
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Warnf("could not parse client certificate: %s", err)
+		return nil
+	}
+	return cert
+}
+
+// certIdentity returns the email a client certificate
+// stands for: its first email SAN, or else its common name
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/spf13/viper"
+)
+
+// writeTestCert writes a self signed certificate for cn and its key to
+// dir/cert.pem and dir/key.pem, returning the certificate PEM
+func writeTestCert(t *testing.T, dir, cn string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: cn},
+		EmailAddresses: []string{cn + "@foomail.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600); err != nil {
+		t.Fatalf("could not write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("could not write key: %s", err)
+	}
+	return certPEM
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "server")
+
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	tt := []struct {
+		label    string
+		settings map[string]interface{}
+		err      string
+	}{
+		{"no tls", map[string]interface{}{}, ""},
+		{"valid", map[string]interface{}{"tls_cert_file": cert, "tls_key_file": key}, ""},
+		{"missing key", map[string]interface{}{"tls_cert_file": cert}, "tls_cert_file and tls_key_file must be set together"},
+		{"ca without cert", map[string]interface{}{"tls_client_ca_file": cert}, "tls_client_ca_file needs tls_cert_file and tls_key_file"},
+		{"ca for cert header", map[string]interface{}{"tls_client_ca_file": cert, "client_cert_header": "X-Client-Cert"}, ""},
+		{"old version", map[string]interface{}{"tls_cert_file": cert, "tls_key_file": key, "tls_min_version": "1.0"}, "invalid tls_min_version '1.0'"},
+		{"insecure suite", map[string]interface{}{"tls_cert_file": cert, "tls_key_file": key, "tls_cipher_suites": []string{"TLS_RSA_WITH_RC4_128_SHA"}}, "unknown or insecure tls cipher suite 'TLS_RSA_WITH_RC4_128_SHA'"},
+		{"missing file", map[string]interface{}{"tls_cert_file": cert + ".xablau", "tls_key_file": key}, "could not stat"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			v := viper.New()
+			v.SetDefault("tls_min_version", "1.2")
+			for k, val := range tc.settings {
+				v.Set(k, val)
+			}
+
+			c, err := loadTLSConfig(v)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error '%s'; got '%v'", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error; got '%s'", err)
+			}
+			if _, ok := tc.settings["tls_cert_file"]; ok && (c == nil || c.MinVersion != tls.VersionTLS12) {
+				t.Errorf("expected tls 1.2 config; got %v", c)
+			}
+		})
+	}
+
+	v := viper.New()
+	v.Set("tls_cert_file", cert)
+	v.Set("tls_key_file", key)
+	v.Set("tls_min_version", "1.3")
+	v.Set("tls_client_ca_file", cert)
+	v.Set("tls_client_cert_required", true)
+
+	c, err := loadTLSConfig(v)
+	if err != nil {
+		t.Fatalf("expected no error; got '%s'", err)
+	}
+	if c.MinVersion != tls.VersionTLS13 || c.ClientAuth != tls.RequireAndVerifyClientCert || c.ClientCAs == nil {
+		t.Errorf("expected tls 1.3 requiring client certificates; got %v", c)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "before")
+
+	cr, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatalf("could not load certificate: %s", err)
+	}
+
+	writeTestCert(t, dir, "after")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{"cert.pem", "key.pem"} {
+		if err := os.Chtimes(filepath.Join(dir, f), later, later); err != nil {
+			t.Fatalf("could not touch %s: %s", f, err)
+		}
+	}
+
+	// not checked again until certCheckInterval passes
+	cr.checked = time.Now()
+	c, _ := cr.GetCertificate(nil)
+	if x, _ := x509.ParseCertificate(c.Certificate[0]); x.Subject.CommonName != "before" {
+		t.Errorf("expected certificate before; got %s", x.Subject.CommonName)
+	}
+
+	cr.checked = time.Time{}
+	c, _ = cr.GetCertificate(nil)
+	if x, _ := x509.ParseCertificate(c.Certificate[0]); x.Subject.CommonName != "after" {
+		t.Errorf("expected reloaded certificate after; got %s", x.Subject.CommonName)
+	}
+}
+
+// testCA is a throwaway CA issuing client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create ca certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse ca certificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue returns the PEM of a certificate for cn signed by the CA, for usage
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: cn},
+		EmailAddresses: []string{cn + "@foomail.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestClientCertHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	signed := ca.issue(t, "service", x509.ExtKeyUsageClientAuth)
+	block, _ := pem.Decode(signed)
+
+	tt := []struct {
+		label      string
+		remote     string
+		tls        bool
+		header     string
+		thumbprint string
+	}{
+		{"signed from trusted proxy", "10.0.0.1:4242", false, url.PathEscape(string(signed)), access.CertThumbprint(block.Bytes)},
+		{"self signed", "10.0.0.1:4242", false, url.PathEscape(string(writeTestCert(t, dir, "service"))), ""},
+		{"not for client auth", "10.0.0.1:4242", false, url.PathEscape(string(ca.issue(t, "service", x509.ExtKeyUsageServerAuth))), ""},
+		{"untrusted client", "192.0.2.7:4242", false, url.PathEscape(string(signed)), ""},
+		{"tls without certificate", "10.0.0.1:4242", true, url.PathEscape(string(signed)), ""},
+		{"no certificate", "10.0.0.1:4242", false, "", ""},
+		{"malformed", "10.0.0.1:4242", false, "xablau", ""},
+	}
+
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("could not parse trusted proxies: %s", err)
+	}
+	ah := &accessHandler{acc, nil, &config{trustedProxies: proxies, clientCertHeader: "X-Client-Cert", clientCAs: ca.pool}}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/token/certificate", nil)
+			req.RemoteAddr = tc.remote
+			req.Header.Set("X-Client-Cert", tc.header)
+			if tc.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			if d := ah.device(req); d.CertThumbprint != tc.thumbprint {
+				t.Errorf("expected thumbprint '%s'; got '%s'", tc.thumbprint, d.CertThumbprint)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("POST", "/token/certificate", nil)
+	req.RemoteAddr = "10.0.0.1:4242"
+	req.Header.Set("X-Client-Cert", url.PathEscape(string(signed)))
+	if c := ah.clientCert(req); c == nil || certIdentity(c) != "service@foomail.com" {
+		t.Errorf("expected identity service@foomail.com; got %v", c)
+	}
+}
+
+func TestPostCertificateTokenHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatalf("could not parse trusted proxies: %s", err)
+	}
+	c := *conf
+	c.trustedProxies, c.clientCertHeader, c.clientCAs = proxies, "X-Client-Cert", newTestCA(t).pool
+	ah := &accessHandler{acc, &tmplHandler{tmpl}, &c}
+
+	tt := []struct {
+		label  string
+		header string
+	}{
+		{"no certificate", ""},
+		{"self signed header", url.PathEscape(string(writeTestCert(t, dir, "admin")))},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/token/certificate", nil)
+			req.RemoteAddr = "10.0.0.1:4242"
+			req.Header.Set("X-Client-Cert", tc.header)
+
+			w := httptest.NewRecorder()
+			ah.postCertificateTokenHandler(w, req)
+
+			if w.Code != 401 {
+				t.Errorf("expected status code 401; got %d", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), "client certificate required") {
+				t.Errorf("expected cause client certificate required; got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCheckBinding(t *testing.T) {
+	bound := &access.Claim{Confirmation: &access.Confirmation{X5tS256: "c2VydmljZQ"}}
+
+	tt := []struct {
+		label      string
+		claim      *access.Claim
+		thumbprint string
+		ok         bool
+	}{
+		{"unbound without certificate", &access.Claim{}, "", true},
+		{"unbound with certificate", &access.Claim{}, "c2VydmljZQ", true},
+		{"bound with its certificate", bound, "c2VydmljZQ", true},
+		{"bound without certificate", bound, "", false},
+		{"bound with another certificate", bound, "eGFibGF1", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			rerr := checkBinding(context.Background(), tc.claim, access.Device{CertThumbprint: tc.thumbprint})
+			if (rerr == nil) != tc.ok {
+				t.Errorf("expected ok %t; got %v", tc.ok, rerr)
+			}
+			if rerr != nil && rerr.Code != 401 {
+				t.Errorf("expected status code 401; got %d", rerr.Code)
+			}
+		})
+	}
+}
@@ -1,31 +1,48 @@
 package server
 
 import (
+	"context"
 	"html"
 	"net/http"
+	"time"
 
+	"github.com/betalotest/auth/server/access"
+	"github.com/betalotest/auth/server/metrics"
 	"github.com/betalotest/auth/server/validation"
-	log "github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
+// hashRetryAfter is when clients turned away with the
+// password hashing queue full are told to come back
+const hashRetryAfter = time.Second
+
+type tokenResponse struct {
+	Token          string `json:"token"`
+	ExpirationDate int64  `json:"expires_at"`
+}
+
 // Render a template for retrieving a new token
 func (th *tmplHandler) getTokenHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
-	if err := th.ExecuteTemplate(w, "token_form.tmpl", nil); err != nil {
-		log.Warnf("could not execute token tmpl for get request: %s", err)
-		renderError(w, th.Lookup("errors.tmpl"), responseError{})
+	if err := th.ExecuteTemplate(w, "token_form.tmpl", formData(r, nil)); err != nil {
+		logger(r.Context()).Warnf("could not execute token tmpl for get request: %s", err)
+		renderError(w, r, th.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
 	}
 }
 
 // Parses the form with user email and password,
 // check if user exists in DB and compare password
 // with password hash from DB.
-// If everything is okay, generates a new JWT, stores it
-// at 'access' collection and send back to user with expiration date
+// If everything is okay, API clients get a new JWT, stored
+// at 'access' collection, with its expiration date and
+// browsers a session cookie
 func (ah *accessHandler) postTokenHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		log.Warnf("could not parse token request form: %s", err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+		logger(r.Context()).Warnf("could not parse token request form: %s", err)
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
 			Code:        http.StatusInternalServerError,
 			Description: "Internal Server Error",
 		})
@@ -40,8 +57,8 @@ func (ah *accessHandler) postTokenHandler(w http.ResponseWriter, r *http.Request
 
 	for k, v := range data {
 		if v == "" {
-			log.Warnf("%s is empty", k)
-			renderError(w, ah.Lookup("error.tmpl"), responseError{
+			logger(r.Context()).Warnf("%s is empty", k)
+			renderError(w, r, ah.Lookup("error.tmpl"), responseError{
 				Code:        http.StatusBadRequest,
 				Description: "Bad Request",
 				Cause:       "missing form data",
@@ -50,80 +67,325 @@ func (ah *accessHandler) postTokenHandler(w http.ResponseWriter, r *http.Request
 		}
 	}
 
+	user, rerr := ah.authenticate(r.Context(), data["email"], data["password"], ah.device(r))
+	if rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+
+	ah.login(w, r, user, "password")
+}
+
+// login hands out access to an user authenticated with method,
+// API clients get a token and browsers a session. The login is
+// audited once either of them is handed out
+func (ah *accessHandler) login(w http.ResponseWriter, r *http.Request, user access.User, method string) {
+	success := access.AuditEvent{Action: access.AuditLoginSuccess, Actor: user.ID, Target: user.ID, Detail: method}
+
+	if wantsJSON(r) {
+		resp, rerr := ah.issueToken(r.Context(), user, ah.device(r))
+		if rerr != nil {
+			renderJSONError(w, *rerr)
+			return
+		}
+		ah.audit(r.Context(), success, ah.device(r))
+		renderJSON(w, http.StatusCreated, resp)
+		return
+	}
+
+	if rerr := ah.startSession(w, r, user); rerr != nil {
+		renderError(w, r, ah.Lookup("error.tmpl"), *rerr)
+		return
+	}
+	ah.audit(r.Context(), success, ah.device(r))
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := ah.ExecuteTemplate(w, "login_success.tmpl", formData(r, user)); err != nil {
+
+		logger(r.Context()).Warnf("could not execute login success tmpl: %s", err)
+
+		renderError(w, r, ah.Lookup("error.tmpl"), responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+}
+
+// postCertificateTokenHandler issue a token to a service client with a
+// verified client certificate, as the user whose email the certificate
+// names. The token is bound to the certificate
+func (ah *accessHandler) postCertificateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	cert := ah.clientCert(r)
+	if cert == nil {
+		renderJSONError(w, responseError{
+			Code:        http.StatusUnauthorized,
+			Description: "Unauthorized",
+			Cause:       "client certificate required",
+		})
+		return
+	}
+
+	d := ah.device(r)
+	email := certIdentity(cert)
+	failed := func(actor, detail string) {
+		ah.audit(r.Context(), access.AuditEvent{Action: access.AuditLoginFailure, Actor: actor, Target: email, Detail: detail}, d)
+		metrics.FailedLogins.WithLabelValues(detail).Inc()
+	}
+
+	user, err := ah.FindUserByEmail(r.Context(), email)
+	if err != nil {
+		logger(r.Context()).Warnf("could not find user %s of client certificate: %s", email, err)
+		failed("", "unknown certificate")
+		renderJSONError(w, responseError{
+			Code:        http.StatusUnauthorized,
+			Description: "Unauthorized",
+			Cause:       "unknown certificate",
+		})
+		return
+	}
+
+	if user.Disabled {
+		logger(r.Context()).Warnf("user %s is disabled", user.Email)
+		failed(user.ID, "account disabled")
+		renderJSONError(w, responseError{
+			Code:        http.StatusForbidden,
+			Description: "Forbidden",
+			Cause:       "account disabled",
+		})
+		return
+	}
+
+	resp, rerr := ah.issueToken(r.Context(), user, d)
+	if rerr != nil {
+		renderJSONError(w, *rerr)
+		return
+	}
+
+	ah.audit(r.Context(), access.AuditEvent{Action: access.AuditLoginSuccess, Actor: user.ID, Target: user.ID, Detail: "client certificate"}, d)
+	renderJSON(w, http.StatusCreated, resp)
+}
+
+// postRefreshHandler trade a valid bearer token for a new one,
+// picking up any change to the user roles in the meantime
+func (ah *accessHandler) postRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if rerr := rejectPersonalToken(bearerToken(r)); rerr != nil {
+		renderJSONError(w, *rerr)
+		return
+	}
+
+	resp, rerr := ah.refreshToken(r.Context(), claimFromContext(r.Context()), ah.device(r))
+	if rerr != nil {
+		renderJSONError(w, *rerr)
+		return
+	}
+	renderJSON(w, http.StatusCreated, resp)
+}
+
+// postRevokeHandler revoke the bearer token, the other tokens
+// of its owner stay valid
+func (ah *accessHandler) postRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if rerr := rejectPersonalToken(bearerToken(r)); rerr != nil {
+		renderJSONError(w, *rerr)
+		return
+	}
+
+	if rerr := ah.revokeToken(r.Context(), claimFromContext(r.Context()), ah.device(r)); rerr != nil {
+		renderJSONError(w, *rerr)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticate checks the email and password of a user against the DB,
+// returning the error to render if the user can't log in.
+// Wrong passwords count towards locking the account, failed
+// logins of known emails are audited along with the device d
+func (ah *accessHandler) authenticate(ctx context.Context, email, password string, d access.Device) (access.User, *responseError) {
+	failed := func(actor, detail string) {
+		ah.audit(ctx, access.AuditEvent{Action: access.AuditLoginFailure, Actor: actor, Target: email, Detail: detail}, d)
+		metrics.FailedLogins.WithLabelValues(detail).Inc()
+	}
+
 	// check if valid email
-	if err := validation.ValidateEmail(data["email"]); err != nil {
-		log.Warnf("could not validate email: ", err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+	if err := validation.ValidateEmail(email); err != nil {
+		logger(ctx).Warnf("could not validate email: %s", err)
+		return access.User{}, &responseError{
 			Code:        http.StatusBadRequest,
 			Description: "Bad Request",
 			Cause:       "invalid email",
-		})
-		return
+		}
 	}
 
 	// get user details
-	user, err := ah.FindUserByEmail(data["email"])
+	user, err := ah.FindUserByEmail(ctx, email)
 	if err != nil {
-		log.Warnf("could not find user %s: %s", data["email"], err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+		logger(ctx).Warnf("could not find user %s: %s", email, err)
+		failed("", "unknown email")
+		return access.User{}, &responseError{
 			Code:        http.StatusNotFound,
 			Description: "Not Found",
-		})
-		return
+		}
+	}
+
+	if user.Disabled {
+		logger(ctx).Warnf("user %s is disabled", user.Email)
+		failed(user.ID, "account disabled")
+		return access.User{}, &responseError{
+			Code:        http.StatusForbidden,
+			Description: "Forbidden",
+			Cause:       "account disabled",
+		}
+	}
+
+	if user.Locked(time.Now()) {
+		logger(ctx).Warnf("user %s is locked", user.Email)
+		failed(user.ID, "account locked")
+		return access.User{}, &responseError{
+			Code:        http.StatusForbidden,
+			Description: "Forbidden",
+			Cause:       "account locked",
+		}
 	}
 
 	// check if password hash match with input provided by the user
-	if err := validation.ComparePasswordHash(data["password"], user.PasswordHash); err != nil {
-		log.Warnf("password comparison check failed: %s", err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+	if err := validation.ComparePasswordHash(ctx, password, user.PasswordHash); err != nil {
+		if rerr := hashUnavailable(err); rerr != nil {
+			logger(ctx).Warnf("could not compare password of user %s: %s", user.Email, err)
+			return access.User{}, rerr
+		}
+		logger(ctx).Warnf("password comparison check failed: %s", err)
+		if err := ah.RecordFailedLogin(ctx, user.ID); err != nil {
+			logger(ctx).Errorf("could not record failed login: %s", err)
+		}
+		failed(user.ID, "invalid password")
+		return access.User{}, &responseError{
 			Code:        http.StatusBadRequest,
 			Description: "Bad Request",
 			Cause:       "invalid password",
-		})
-		return
+		}
+	}
+
+	if user.FailedLogins > 0 {
+		if err := ah.ResetFailedLogins(ctx, user.ID); err != nil {
+			logger(ctx).Errorf("could not reset failed logins: %s", err)
+		}
+	}
+	return user, nil
+}
+
+// hashUnavailable returns the error to render when err tells password
+// hashing did not run: the queue being full, when the client is asked
+// to come back later, or the request being cancelled. Nil otherwise
+func hashUnavailable(err error) *responseError {
+	switch errors.Cause(err) {
+	case validation.ErrHashBusy:
+		return &responseError{
+			Code:        http.StatusServiceUnavailable,
+			Description: "Service Unavailable",
+			Cause:       "too many requests, retry later",
+			RetryAfter:  hashRetryAfter,
+		}
+	case context.Canceled, context.DeadlineExceeded:
+		return &responseError{
+			Code:        http.StatusServiceUnavailable,
+			Description: "Service Unavailable",
+			Cause:       "request cancelled",
+		}
+	}
+	return nil
+}
+
+// issueToken generates a new JWT for an authenticated user
+// and records it along with the device it is issued to
+func (ah *accessHandler) issueToken(ctx context.Context, user access.User, d access.Device) (tokenResponse, *responseError) {
+	if rerr := checkPasswordReset(ctx, user); rerr != nil {
+		return tokenResponse{}, rerr
 	}
 
 	// get new token
-	token, exp, err := ah.NewToken(user.Name, user.Email)
+	token, exp, err := ah.IssueToken(ctx, user, d)
 	if err != nil {
-		log.Warnf("could not create a new token for user %s: %s", user.Email, err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+		logger(ctx).Warnf("could not issue a new token for user %s: %s", user.Email, err)
+		return tokenResponse{}, &responseError{
 			Code:        http.StatusInternalServerError,
 			Description: "Internal Server Error",
-		})
-		return
+		}
 	}
 
-	// store token
-	if err := ah.UpdateToken(user.Email, token); err != nil {
-		log.Warnf("could not update token for user %s: %s", user.Email, err)
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
-			Code:        http.StatusInternalServerError,
-			Description: "Internal Server Error",
-		})
-		return
+	logger(ctx).Infof("new token generated for user %s", user.Email)
+	metrics.TokensIssued.Inc()
+	ah.audit(ctx, access.AuditEvent{Action: access.AuditTokenIssued, Actor: user.ID, Target: user.ID}, d)
+	ah.notify(ctx, access.WebhookTokenIssued, access.TokenIssuedData{UserID: user.ID, Email: user.Email, ExpiresAt: exp})
+	return tokenResponse{token, exp}, nil
+}
+
+// checkPasswordReset makes users pick a new password
+// before getting tokens or sessions again
+func checkPasswordReset(ctx context.Context, user access.User) *responseError {
+	if user.PasswordResetRequired {
+		logger(ctx).Warnf("user %s must reset password", user.Email)
+		return &responseError{
+			Code:        http.StatusForbidden,
+			Description: "Forbidden",
+			Cause:       "password reset required",
+		}
 	}
+	return nil
+}
 
-	log.Infof("new token generated for user %s", user.Email)
+// refreshToken issues a new token for the owner of the verified claim c,
+// revoking c first so each token is only traded once
+func (ah *accessHandler) refreshToken(ctx context.Context, c *access.Claim, d access.Device) (tokenResponse, *responseError) {
+	user, err := ah.FindUserByID(ctx, c.Subject)
+	if err != nil {
+		logger(ctx).Warnf("could not find user %s: %s", c.Subject, err)
+		return tokenResponse{}, &responseError{
+			Code:        http.StatusUnauthorized,
+			Description: "Unauthorized",
+			Cause:       "invalid token",
+		}
+	}
 
-	w.WriteHeader(http.StatusCreated)
+	// tokens issued before they had IDs can't be revoked one by one
+	if c.Id != "" {
+		if err := ah.RevokeToken(ctx, user.ID, c.Id); err != nil {
+			return tokenResponse{}, claimError(ctx, err)
+		}
+	}
+	return ah.issueToken(ctx, user, d)
+}
 
-	resp := struct {
-		token          string
-		expirationDate int64
-	}{
-		token,
-		exp,
+// revokeToken revokes the token of the verified claim c, asked for from
+// the device d. Tokens issued before they had IDs can't be revoked one
+// by one, so every token of their owner is
+func (ah *accessHandler) revokeToken(ctx context.Context, c *access.Claim, d access.Device) *responseError {
+	if c.Id == "" {
+		return ah.revokeTokens(ctx, c, d)
 	}
 
-	if err := ah.ExecuteTemplate(w, "token_success.tmpl", resp); err != nil {
+	if err := ah.RevokeToken(ctx, c.Subject, c.Id); err != nil {
+		return claimError(ctx, err)
+	}
 
-		log.Warnf("could not execute success tmpl for post signup request: %s", err)
+	logger(ctx).Infof("token %s revoked for user %s", c.Id, c.Subject)
+	ah.audit(ctx, access.AuditEvent{Action: access.AuditTokensRevoked, Actor: c.Subject, Target: c.Subject, Detail: c.Id}, d)
+	return nil
+}
 
-		renderError(w, ah.Lookup("error.tmpl"), responseError{
+// revokeTokens revokes every token of the owner of the verified claim c,
+// asked for from the device d
+func (ah *accessHandler) revokeTokens(ctx context.Context, c *access.Claim, d access.Device) *responseError {
+	if err := ah.RevokeTokens(ctx, c.Subject); err != nil {
+		logger(ctx).Warnf("could not revoke tokens for user %s: %s", c.Subject, err)
+		return &responseError{
 			Code:        http.StatusInternalServerError,
 			Description: "Internal Server Error",
-		})
-		return
+		}
 	}
+
+	logger(ctx).Infof("tokens revoked for user %s", c.Subject)
+	ah.audit(ctx, access.AuditEvent{Action: access.AuditTokensRevoked, Actor: c.Subject, Target: c.Subject}, d)
+	return nil
 }
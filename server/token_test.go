@@ -2,16 +2,20 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+
+	"github.com/betalotest/auth/server/validation"
+	"github.com/pkg/errors"
 )
 
 func TestGetTokenHandler(t *testing.T) {
-	srv := httptest.NewServer(serverEngine(nil, tmpl))
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
 	defer srv.Close()
 
 	resp, err := http.Get(srv.URL + "/token")
@@ -37,7 +41,7 @@ func TestPostTokenHandler(t *testing.T) {
 		{"invalid email", "xablau@xmail,com", "", "Bad Request", 400},
 	}
 
-	srv := httptest.NewServer(serverEngine(nil, tmpl))
+	srv := httptest.NewServer(serverEngine(nil, tmpl, conf))
 	defer srv.Close()
 
 	for _, tc := range tt {
@@ -53,6 +57,7 @@ func TestPostTokenHandler(t *testing.T) {
 			}
 			req.PostForm = form
 			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			addCSRF(req)
 
 			resp, err := client.Do(req)
 			if err != nil {
@@ -76,3 +81,40 @@ func TestPostTokenHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestHashUnavailable(t *testing.T) {
+	tt := []struct {
+		label      string
+		err        error
+		code       int
+		retryAfter string
+	}{
+		{"queue full", errors.Wrap(validation.ErrHashBusy, "password comparison failed"), http.StatusServiceUnavailable, "1"},
+		{"client gone", errors.Wrap(context.Canceled, "password comparison failed"), http.StatusServiceUnavailable, ""},
+		{"wrong password", errors.New("password and password comparison failed"), 0, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			rerr := hashUnavailable(tc.err)
+			if tc.code == 0 {
+				if rerr != nil {
+					t.Errorf("expected no error; got %v", rerr)
+				}
+				return
+			}
+			if rerr == nil {
+				t.Fatalf("expected status %d; got none", tc.code)
+			}
+
+			w := httptest.NewRecorder()
+			renderJSONError(w, *rerr)
+			if w.Code != tc.code {
+				t.Errorf("expected status %d; got %d", tc.code, w.Code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tc.retryAfter {
+				t.Errorf("expected Retry-After %q; got %q", tc.retryAfter, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package tracing
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	tt := []struct {
+		label string
+		conf  Config
+		valid bool
+	}{
+		{"none", Config{Exporter: ExporterNone, SampleRatio: 1}, true},
+		{"otlp", Config{Exporter: ExporterOTLP, OTLPEndpoint: "localhost:4317", SampleRatio: 0.1}, true},
+		{"stdout", Config{Exporter: ExporterStdout}, true},
+		{"unknown exporter", Config{Exporter: "zipkin", SampleRatio: 1}, false},
+		{"negative ratio", Config{Exporter: ExporterNone, SampleRatio: -0.5}, false},
+		{"ratio above one", Config{Exporter: ExporterNone, SampleRatio: 2}, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if err := tc.conf.Validate(); (err == nil) != tc.valid {
+				t.Errorf("expected valid %t; got %v", tc.valid, err)
+			}
+		})
+	}
+}
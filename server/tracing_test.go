@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/betalotest/auth/server/logging"
+	"github.com/betalotest/auth/server/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracePropagation(t *testing.T) {
+	if _, err := tracing.Setup(tracing.Config{Exporter: tracing.ExporterNone}); err != nil {
+		t.Fatalf("could not set up tracing: %s", err)
+	}
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	ah := &accessHandler{acc, &tmplHandler{tmpl}, conf}
+	h := ah.instrument("GET", "/login/magic", func(w http.ResponseWriter, r *http.Request) {
+		if got := logging.FromContext(r.Context()).Data[logging.TraceIDField]; got != traceID {
+			t.Errorf("expected the request logger to have trace id %s; got %v", traceID, got)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest("GET", "/login/magic", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	h(httptest.NewRecorder(), req)
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span; got %d", len(spans))
+	}
+	s := spans[0]
+
+	tt := []struct {
+		label string
+		ok    bool
+	}{
+		{"name", s.Name() == "GET /login/magic"},
+		{"server kind", s.SpanKind() == trace.SpanKindServer},
+		{"continues trace", s.SpanContext().TraceID().String() == traceID},
+		{"remote parent", s.Parent().SpanID().String() == "00f067aa0ba902b7"},
+		{"error status", s.Status().Code.String() == "Error"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if !tc.ok {
+				t.Errorf("unexpected span %s: %+v", tc.label, s)
+			}
+		})
+	}
+}
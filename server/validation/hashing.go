@@ -0,0 +1,86 @@
+package validation
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/betalotest/auth/server/metrics"
+	"github.com/pkg/errors"
+)
+
+// DefaultHashQueueDepth is how many hashes may wait for a worker by default
+const DefaultHashQueueDepth = 64
+
+// ErrHashBusy is returned when every hashing worker is busy
+// and the queue is full, callers should retry later
+var ErrHashBusy = errors.New("password hashing queue is full")
+
+// hashing bounds the bcrypt work of CreatePasswordHash and ComparePasswordHash
+var hashing = newScheduler(runtime.NumCPU(), DefaultHashQueueDepth)
+
+// scheduler runs at most cap(slots) hashes at once, letting up to
+// cap(queue) more wait for a slot and refusing the rest
+type scheduler struct {
+	slots chan struct{}
+	queue chan struct{}
+}
+
+func newScheduler(concurrency, queueDepth int) *scheduler {
+	return &scheduler{
+		slots: make(chan struct{}, concurrency),
+		queue: make(chan struct{}, queueDepth),
+	}
+}
+
+// SetHashLimits - run at most concurrency password hashes at once, with
+// up to queueDepth more waiting. Must be called before any hashing
+func SetHashLimits(concurrency, queueDepth int) error {
+	if concurrency < 1 {
+		return errors.Errorf("hash concurrency should be > 0; instead of %d", concurrency)
+	}
+	if queueDepth < 0 {
+		return errors.Errorf("hash queue depth should be >= 0; instead of %d", queueDepth)
+	}
+	hashing = newScheduler(concurrency, queueDepth)
+	return nil
+}
+
+// acquire - wait for a free slot to hash, op being create or compare.
+// Returns ErrHashBusy right away when the queue is full, and the error
+// of ctx when it is done first, as when the client went away. The
+// returned func frees the slot
+func (s *scheduler) acquire(ctx context.Context, op string) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		select {
+		case s.queue <- struct{}{}:
+		default:
+			metrics.HashRejected.WithLabelValues(op).Inc()
+			return nil, ErrHashBusy
+		}
+
+		metrics.HashQueued.Inc()
+		var err error
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		<-s.queue
+		metrics.HashQueued.Dec()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metrics.HashQueueWait.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	return func() { <-s.slots }, nil
+}
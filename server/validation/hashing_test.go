@@ -0,0 +1,99 @@
+package validation
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerAcquire(t *testing.T) {
+	s := newScheduler(1, 1)
+
+	release, err := s.acquire(context.Background(), "create")
+	if err != nil {
+		t.Fatalf("expected a free slot; got %s", err)
+	}
+
+	queued := make(chan error)
+	go func() {
+		r, err := s.acquire(context.Background(), "create")
+		if err == nil {
+			r()
+		}
+		queued <- err
+	}()
+
+	// wait for the second hash to take the queue
+	for len(s.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := s.acquire(context.Background(), "create"); err != ErrHashBusy {
+		t.Errorf("expected ErrHashBusy with the queue full; got %v", err)
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("expected the queued hash to run once the slot freed; got %s", err)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	tt := []struct {
+		label string
+		busy  bool
+	}{
+		{"cancelled before", false},
+		{"cancelled while queued", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			s := newScheduler(1, 1)
+			if tc.busy {
+				release, err := s.acquire(context.Background(), "compare")
+				if err != nil {
+					t.Fatalf("expected a free slot; got %s", err)
+				}
+				defer release()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if !tc.busy {
+				cancel()
+			}
+
+			if _, err := s.acquire(ctx, "compare"); err != ctx.Err() {
+				t.Errorf("expected the context error; got %v", err)
+			}
+			if len(s.queue) != 0 {
+				t.Errorf("expected the queue to be left empty; got %d", len(s.queue))
+			}
+		})
+	}
+}
+
+func TestSetHashLimits(t *testing.T) {
+	defer func(s *scheduler) { hashing = s }(hashing)
+
+	tt := []struct {
+		label       string
+		concurrency int
+		queueDepth  int
+		valid       bool
+	}{
+		{"valid", 4, 16, true},
+		{"no queue", 1, 0, true},
+		{"no workers", 0, 16, false},
+		{"negative queue", 4, -1, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if err := SetHashLimits(tc.concurrency, tc.queueDepth); (err == nil) != tc.valid {
+				t.Errorf("expected valid %t; got %v", tc.valid, err)
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package validation
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/betalotest/auth/server/metrics"
+	"github.com/betalotest/auth/server/tracing"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -126,10 +131,23 @@ func ValidatePassword(password, passwordCheck string) error {
 	return nil
 }
 
-// CreatePasswordHash - given a password use
-// bcrypt to generate a password hash
-func CreatePasswordHash(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+// bcryptCost is the cost of the password hashes
+const bcryptCost = 14
+
+// CreatePasswordHash - given a password use bcrypt to generate a
+// password hash, once the hashing scheduler lets it run. Fails with
+// ErrHashBusy when its queue is full, or the error of ctx
+func CreatePasswordHash(ctx context.Context, password string) (string, error) {
+	release, err := hashing.acquire(ctx, "create")
+	if err != nil {
+		return "", errors.Wrap(err, "password hash creation failed")
+	}
+	defer release()
+	defer prometheus.NewTimer(metrics.HashDuration.WithLabelValues("create")).ObserveDuration()
+
+	_, span := tracing.Start(ctx, "bcrypt.create", attribute.Int("bcrypt.cost", bcryptCost))
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	tracing.End(span, err)
 	if err != nil {
 		return "", errors.Wrap(err, "password hash creation failed")
 	}
@@ -137,9 +155,20 @@ func CreatePasswordHash(password string) (string, error) {
 }
 
 // ComparePasswordHash - given a password and a password hash use bcrypt
-// to compare both passwords, returning an error if they do not match
-func ComparePasswordHash(password, passwordHash string) error {
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+// to compare both passwords, returning an error if they do not match.
+// Scheduled like CreatePasswordHash
+func ComparePasswordHash(ctx context.Context, password, passwordHash string) error {
+	release, err := hashing.acquire(ctx, "compare")
+	if err != nil {
+		return errors.Wrap(err, "password comparison failed")
+	}
+	defer release()
+	defer prometheus.NewTimer(metrics.HashDuration.WithLabelValues("compare")).ObserveDuration()
+
+	_, span := tracing.Start(ctx, "bcrypt.compare")
+	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	span.End()
+	if err != nil {
 		return fmt.Errorf("password and password comparison failed: %s", err)
 	}
 	return nil
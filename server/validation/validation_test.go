@@ -1,6 +1,7 @@
 package validation
 
 import (
+	"context"
 	"regexp"
 	"testing"
 )
@@ -208,7 +209,7 @@ func TestCreatePasswordHash(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.label, func(t *testing.T) {
-			passwordHash, err := CreatePasswordHash(tc.password)
+			passwordHash, err := CreatePasswordHash(context.Background(), tc.password)
 			if err != nil {
 				t.Error(err) // we really can't make bcrypt fail =]
 			}
@@ -243,7 +244,7 @@ func TestComparePasswordHash(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.label, func(t *testing.T) {
-			if err := ComparePasswordHash(tc.password, tc.passwordCheck); err != nil {
+			if err := ComparePasswordHash(context.Background(), tc.password, tc.passwordCheck); err != nil {
 				if err.Error() != tc.err {
 					t.Errorf("expected error '%s'; got '%s'", tc.err, err)
 				}
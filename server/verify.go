@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// getVerifyHandler lets reverse proxies (nginx auth_request, Traefik
+// or Caddy forward auth) check the token or the browser session of
+// the requests they proxy. Valid ones get a 200 with the identity
+// headers to pass upstream, the rest a 401
+func (ah *accessHandler) getVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	// requests without a token may come from a logged in browser
+	if bearerToken(r) == "" {
+		if _, err := r.Cookie(sessionCookie); err == nil {
+			u, _, rerr := ah.sessionUser(r)
+			if rerr != nil {
+				renderJSONError(w, *rerr)
+				return
+			}
+			setIdentityHeaders(w, u.ID, u.Email, u.EffectiveRoles())
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	// the client certificate only shows when the proxy passes it in client_cert_header
+	c, rerr := ah.verifyToken(r.Context(), bearerToken(r), "")
+	if rerr == nil {
+		rerr = checkBinding(r.Context(), c, ah.device(r))
+	}
+	if rerr != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		renderJSONError(w, *rerr)
+		return
+	}
+
+	setIdentityHeaders(w, c.Subject, c.Email, c.Roles)
+	w.WriteHeader(http.StatusOK)
+}
+
+func setIdentityHeaders(w http.ResponseWriter, id, email string, roles []string) {
+	w.Header().Set("X-Auth-User", id)
+	w.Header().Set("X-Auth-Email", email)
+	w.Header().Set("X-Auth-Roles", strings.Join(roles, ","))
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetVerifyHandler(t *testing.T) {
+	tt := []struct {
+		label      string
+		method     string
+		auth       string
+		statusCode int
+	}{
+		{"missing token", "GET", "", 401},
+		{"invalid token", "GET", "Bearer xablau", 401},
+		{"head invalid token", "HEAD", "Bearer xablau", 401},
+	}
+
+	srv := httptest.NewServer(serverEngine(acc, tmpl, conf))
+	defer srv.Close()
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, srv.URL+"/auth/verify", nil)
+			if err != nil {
+				t.Fatalf("could not create request: %s", err)
+			}
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute request: %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+
+			if resp.Header.Get("X-Auth-User") != "" {
+				t.Errorf("expected no identity headers; got X-Auth-User '%s'", resp.Header.Get("X-Auth-User"))
+			}
+		})
+	}
+}
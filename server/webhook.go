@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+)
+
+const (
+	// webhookPoll is how often the delivery queue is checked
+	webhookPoll = time.Second
+
+	// webhookLease is how long a claimed delivery is kept from other servers
+	webhookLease = time.Minute
+
+	// webhookTimeout bounds a single delivery attempt
+	webhookTimeout = 10 * time.Second
+
+	// maxWebhookAttempts is how many times a delivery is tried before failing for good
+	maxWebhookAttempts = 8
+
+	// the wait before retrying doubles from minWebhookBackoff up to maxWebhookBackoff
+	minWebhookBackoff = 30 * time.Second
+	maxWebhookBackoff = time.Hour
+)
+
+// headers of webhook requests
+const (
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// notify queues the webhook deliveries of the event,
+// failing to queue them is logged and the request goes on
+func (ah *accessHandler) notify(ctx context.Context, event string, data interface{}) {
+	if err := ah.QueueWebhook(ctx, event, data); err != nil {
+		logger(ctx).Errorf("could not queue webhook %s: %s", event, err)
+	}
+}
+
+// webhookDispatcher sends the queued webhook deliveries to their subscriptions
+type webhookDispatcher struct {
+	*access.Access
+	subs   map[string]access.Subscription
+	client *http.Client
+}
+
+func newWebhookDispatcher(a *access.Access) *webhookDispatcher {
+	subs := make(map[string]access.Subscription, len(a.Webhooks))
+	for _, s := range a.Webhooks {
+		subs[s.Name] = s
+	}
+	return &webhookDispatcher{a, subs, &http.Client{Timeout: webhookTimeout}}
+}
+
+// run sends due deliveries every webhookPoll until stop is closed. Sends
+// in flight are given up when ctx is done
+func (wd *webhookDispatcher) run(ctx context.Context, stop <-chan struct{}) {
+	t := time.NewTicker(webhookPoll)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			wd.drain(ctx, stop)
+		}
+	}
+}
+
+// drain sends every delivery due by now, or until stop is closed
+func (wd *webhookDispatcher) drain(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		d, err := wd.ClaimDelivery(ctx, time.Now(), webhookLease)
+		if err == mgo.ErrNotFound {
+			return
+		}
+		if err != nil {
+			log.Errorf("could not claim webhook delivery: %s", err)
+			return
+		}
+		wd.deliver(ctx, d)
+	}
+}
+
+// deliver attempts the delivery and records the outcome,
+// scheduling a retry with backoff while attempts are left
+func (wd *webhookDispatcher) deliver(ctx context.Context, d access.Delivery) {
+	var status int
+	var retryAt time.Time
+
+	sub, ok := wd.subs[d.Subscription]
+	err := fmt.Errorf("subscription '%s' no longer configured", d.Subscription)
+	if ok {
+		status, err = wd.send(ctx, sub, d)
+		if err != nil && d.Attempts < maxWebhookAttempts {
+			retryAt = time.Now().Add(webhookBackoff(d.Attempts))
+		}
+	}
+
+	switch {
+	case err == nil:
+		log.Infof("webhook %s %s delivered to %s", d.Event, d.ID, d.Subscription)
+	case retryAt.IsZero():
+		log.Errorf("webhook %s %s to %s failed for good: %s", d.Event, d.ID, d.Subscription, err)
+	default:
+		log.Warnf("webhook %s %s to %s failed, retrying at %s: %s", d.Event, d.ID, d.Subscription, retryAt, err)
+	}
+
+	// recorded even when ctx is done, so the attempt is not lost
+	if err := wd.DeliveryDone(context.Background(), d.ID, status, err, retryAt); err != nil {
+		log.Errorf("could not record webhook delivery %s: %s", d.ID, err)
+	}
+}
+
+// send POSTs the delivery payload to the subscription, signed with its
+// secret. Any status but 2xx is an error. Returns the response status
+func (wd *webhookDispatcher) send(ctx context.Context, sub access.Subscription, d access.Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.URL, strings.NewReader(d.Payload))
+	if err != nil {
+		return 0, errors.Wrap(err, "could not create webhook request")
+	}
+
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(sub.Secret, ts, d.Payload))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not send webhook")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook - the signature header of a webhook body sent at ts:
+// the hex HMAC-SHA256 with the subscription secret of the timestamp,
+// a dot and the body. Receivers should reject stale timestamps
+func signWebhook(secret string, ts int64, body string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(strconv.FormatInt(ts, 10) + "." + body))
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// webhookBackoff - the wait before retrying a delivery attempted attempts times
+func webhookBackoff(attempts int) time.Duration {
+	d := minWebhookBackoff
+	for i := 1; i < attempts && d < maxWebhookBackoff; i++ {
+		d *= 2
+	}
+	if d > maxWebhookBackoff {
+		return maxWebhookBackoff
+	}
+	return d
+}
+
+// listDeliveriesHandler render the webhook delivery log, filtered by the
+// 'status' and 'event' query parameters and paginated like listUsersHandler
+func (ah *accessHandler) listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	switch q.Get("status") {
+	case "", access.DeliveryPending, access.DeliveryDelivered, access.DeliveryFailed:
+	default:
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid status",
+		})
+		return
+	}
+
+	page, err := queryInt(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid page",
+		})
+		return
+	}
+
+	perPage, err := queryInt(q.Get("per_page"), defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		renderJSONError(w, responseError{
+			Code:        http.StatusBadRequest,
+			Description: "Bad Request",
+			Cause:       "invalid per_page",
+		})
+		return
+	}
+
+	deliveries, total, err := ah.ListDeliveries(r.Context(), q.Get("status"), q.Get("event"), (page-1)*perPage, perPage)
+	if err != nil {
+		logger(r.Context()).Warnf("could not list webhook deliveries: %s", err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	resp := struct {
+		Deliveries []access.Delivery `json:"deliveries"`
+		Page       int               `json:"page"`
+		PerPage    int               `json:"per_page"`
+		Total      int               `json:"total"`
+	}{
+		deliveries,
+		page,
+		perPage,
+		total,
+	}
+	renderJSON(w, http.StatusOK, resp)
+}
+
+// postRetryDeliveryHandler queue a failed webhook delivery again
+func (ah *accessHandler) postRetryDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	if err := ah.RetryDelivery(r.Context(), id); err != nil {
+		if errors.Cause(err) == mgo.ErrNotFound {
+			renderJSONError(w, responseError{
+				Code:        http.StatusNotFound,
+				Description: "Not Found",
+				Cause:       "no failed delivery " + id,
+			})
+			return
+		}
+
+		logger(r.Context()).Warnf("could not retry webhook delivery %s: %s", id, err)
+		renderJSONError(w, responseError{
+			Code:        http.StatusInternalServerError,
+			Description: "Internal Server Error",
+		})
+		return
+	}
+
+	actor := claimFromContext(r.Context()).Subject
+	ah.audit(r.Context(), access.AuditEvent{Action: access.AuditWebhookRetried, Actor: actor, Target: id}, ah.device(r))
+
+	logger(r.Context()).Infof("webhook delivery %s queued again by %s", id, actor)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/betalotest/auth/server/access"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	tt := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+
+	for _, tc := range tt {
+		if d := webhookBackoff(tc.attempts); d != tc.backoff {
+			t.Errorf("expected backoff %s after %d attempts; got %s", tc.backoff, tc.attempts, d)
+		}
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	tt := []struct {
+		label  string
+		status int
+		err    bool
+	}{
+		{"delivered", http.StatusNoContent, false},
+		{"rejected", http.StatusBadRequest, true},
+		{"server error", http.StatusServiceUnavailable, true},
+	}
+
+	sub := access.Subscription{Name: "crm", Secret: "foobar", Events: []string{access.WebhookUserCreated}}
+	d := access.Delivery{ID: "9b2e7c4a", Subscription: "crm", Event: access.WebhookUserCreated, Payload: `{"id":"9b2e7c4a"}`}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				ts, err := strconv.ParseInt(r.Header.Get(webhookTimestampHeader), 10, 64)
+				if err != nil {
+					t.Errorf("expected unix timestamp header; got '%s'", r.Header.Get(webhookTimestampHeader))
+				}
+
+				if sig := signWebhook(sub.Secret, ts, string(body)); r.Header.Get(webhookSignatureHeader) != sig {
+					t.Errorf("expected signature %s; got %s", sig, r.Header.Get(webhookSignatureHeader))
+				}
+
+				if r.Header.Get(webhookEventHeader) != d.Event || r.Header.Get(webhookDeliveryHeader) != d.ID {
+					t.Errorf("expected event %s delivery %s; got %s %s", d.Event, d.ID,
+						r.Header.Get(webhookEventHeader), r.Header.Get(webhookDeliveryHeader))
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+
+			sub.URL = srv.URL
+			status, err := newWebhookDispatcher(acc).send(context.Background(), sub, d)
+			if status != tc.status {
+				t.Errorf("expected status %d; got %d", tc.status, status)
+			}
+			if (err != nil) != tc.err {
+				t.Errorf("expected error %t; got '%v'", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestWebhookShutdown(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	wd := newWebhookDispatcher(acc)
+
+	// closed stop keeps drain from claiming, the test access has no db
+	stop := make(chan struct{})
+	close(stop)
+	wd.drain(context.Background(), stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	sub := access.Subscription{Name: "crm", URL: srv.URL, Secret: "foobar"}
+	start := time.Now()
+	if _, err := wd.send(ctx, sub, access.Delivery{ID: "9b2e7c4a", Subscription: "crm"}); err == nil {
+		t.Errorf("expected error sending past the shutdown timeout")
+	}
+	if waited := time.Since(start); waited > webhookTimeout/2 {
+		t.Errorf("expected send to give up with its context; waited %s", waited)
+	}
+}
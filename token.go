@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func tokenCmd(args []string) {
+	sub, args := subcommand("token", args, "issue", "verify", "revoke")
+	fs, confPtr := newFlagSet("token " + sub)
+
+	switch sub {
+	case "issue":
+		emailPtr := fs.String("email", "", "user email")
+		fs.Parse(args)
+
+		acc := mustAccess(*confPtr)
+		u := mustFindUser(acc, *emailPtr)
+
+		token, exp, err := acc.IssueToken(context.Background(), u, access.Device{UserAgent: "auth cli"})
+		if err != nil {
+			log.Fatalf("failed to issue token: %s", err)
+		}
+		cliAudit(acc, access.AuditEvent{Action: access.AuditTokenIssued, Target: u.ID})
+
+		data := access.TokenIssuedData{UserID: u.ID, Email: u.Email, ExpiresAt: exp}
+		if err := acc.QueueWebhook(context.Background(), access.WebhookTokenIssued, data); err != nil {
+			log.Errorf("failed to queue webhook: %s", err)
+		}
+		fmt.Println(token)
+		fmt.Fprintf(os.Stderr, "expires at %d\n", exp)
+
+	case "verify":
+		fs.Usage = func() {
+			fmt.Fprintln(os.Stderr, "usage: auth token verify [-conf file] <token>")
+			fs.PrintDefaults()
+		}
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		acc := mustAccess(*confPtr)
+		c, err := acc.ParseToken(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("invalid token: %s", err)
+		}
+
+		err = acc.VerifyClaim(context.Background(), c)
+		if errors.Cause(err) == access.ErrTokenRevoked {
+			log.Fatalf("revoked token: %s", err)
+		}
+		if err != nil {
+			log.Fatalf("failed to verify token: %s", err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(c)
+
+	case "revoke":
+		emailPtr := fs.String("email", "", "user email")
+		fs.Parse(args)
+
+		acc := mustAccess(*confPtr)
+		u := mustFindUser(acc, *emailPtr)
+		if err := acc.RevokeTokens(context.Background(), u.ID); err != nil {
+			log.Fatalf("failed to revoke tokens: %s", err)
+		}
+		cliAudit(acc, access.AuditEvent{Action: access.AuditTokensRevoked, Target: u.ID})
+		fmt.Printf("tokens revoked for user %s\n", u.Email)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/betalotest/auth/server/access"
+	"github.com/betalotest/auth/server/validation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+func userCmd(args []string) {
+	sub, args := subcommand("user", args, "create", "disable", "reset-password", "roles", "list")
+	fs, confPtr := newFlagSet("user " + sub)
+
+	switch sub {
+	case "create":
+		namePtr := fs.String("name", "", "username")
+		emailPtr := fs.String("email", "", "user email")
+		rolesPtr := fs.String("roles", "", "comma separated roles, defaults to user")
+		fs.Parse(args)
+		createUser(*confPtr, *namePtr, *emailPtr, *rolesPtr)
+
+	case "disable":
+		emailPtr := fs.String("email", "", "user email")
+		enablePtr := fs.Bool("enable", false, "enable the user back instead")
+		fs.Parse(args)
+
+		acc := mustAccess(*confPtr)
+		u := mustFindUser(acc, *emailPtr)
+		if err := acc.SetDisabled(context.Background(), u.ID, !*enablePtr); err != nil {
+			log.Fatalf("failed to disable user: %s", err)
+		}
+		action := access.AuditUserDisable
+		if *enablePtr {
+			action = access.AuditUserEnable
+		}
+		cliAudit(acc, access.AuditEvent{Action: action, Target: u.ID})
+		fmt.Printf("user %s disabled: %t\n", u.Email, !*enablePtr)
+
+	case "reset-password":
+		emailPtr := fs.String("email", "", "user email")
+		fs.Parse(args)
+
+		acc := mustAccess(*confPtr)
+		u := mustFindUser(acc, *emailPtr)
+		if err := acc.RequirePasswordReset(context.Background(), u.ID); err != nil {
+			log.Fatalf("failed to require password reset: %s", err)
+		}
+		cliAudit(acc, access.AuditEvent{Action: access.AuditUserResetPassword, Target: u.ID})
+		fmt.Printf("user %s must reset password\n", u.Email)
+
+	case "roles":
+		emailPtr := fs.String("email", "", "user email")
+		rolesPtr := fs.String("roles", "", "comma separated roles")
+		permsPtr := fs.String("permissions", "", "comma separated permissions granted on top of roles")
+		fs.Parse(args)
+
+		acc := mustAccess(*confPtr)
+		u := mustFindUser(acc, *emailPtr)
+		if err := acc.SetRoles(context.Background(), u.ID, splitList(*rolesPtr), splitList(*permsPtr)); err != nil {
+			log.Fatalf("failed to assign roles: %s", err)
+		}
+		cliAudit(acc, access.AuditEvent{Action: access.AuditUserRoles, Target: u.ID})
+		fmt.Printf("roles %s assigned to user %s\n", *rolesPtr, u.Email)
+
+	case "list":
+		queryPtr := fs.String("q", "", "search users by name or email")
+		pagePtr := fs.Int("page", 1, "page")
+		perPagePtr := fs.Int("per-page", 20, "users per page")
+		fs.Parse(args)
+
+		if *pagePtr < 1 || *perPagePtr < 1 {
+			log.Fatal("-page and -per-page should be > 0")
+		}
+
+		users, total, err := mustAccess(*confPtr).ListUsers(context.Background(), *queryPtr, (*pagePtr-1)**perPagePtr, *perPagePtr)
+		if err != nil {
+			log.Fatalf("failed to list users: %s", err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		for _, u := range users {
+			enc.Encode(u)
+		}
+		fmt.Fprintf(os.Stderr, "page %d, %d of %d users\n", *pagePtr, len(users), total)
+	}
+}
+
+// createUser - validate and register a new user, like signup does.
+// The password is read by readPassword
+func createUser(configfile, name, email, roles string) {
+	if err := validation.ValidateName(name); err != nil {
+		log.Fatalf("invalid -name: %s", err)
+	}
+
+	if err := validation.ValidateEmail(email); err != nil {
+		log.Fatalf("invalid -email: %s", err)
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		log.Fatalf("failed to read password: %s", err)
+	}
+
+	if err := validation.ValidatePassword(password, password); err != nil {
+		log.Fatalf("invalid password: %s", err)
+	}
+
+	ctx := context.Background()
+
+	passwordHash, err := validation.CreatePasswordHash(ctx, password)
+	if err != nil {
+		log.Fatalf("failed to create password hash: %s", err)
+	}
+
+	acc := mustAccess(configfile)
+
+	if _, err := acc.FindUserByEmail(ctx, email); err == nil {
+		log.Fatalf("email '%s' is already in use", email)
+	}
+
+	u, err := acc.RegisterUser(ctx, name, email, passwordHash)
+	if err != nil {
+		log.Fatalf("failed to register user: %s", err)
+	}
+
+	if roles != "" {
+		if err := acc.SetRoles(ctx, u.ID, splitList(roles), nil); err != nil {
+			log.Fatalf("failed to assign roles: %s", err)
+		}
+	}
+	cliAudit(acc, access.AuditEvent{Action: access.AuditUserCreate, Target: u.ID})
+	// delivered by the running servers
+	if err := acc.QueueWebhook(ctx, access.WebhookUserCreated, access.NewUserData(u)); err != nil {
+		log.Errorf("failed to queue webhook: %s", err)
+	}
+	fmt.Printf("user %s created with id %s\n", u.Email, u.ID)
+}
+
+// splitList splits a comma separated flag value, empty means none
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// readPassword prompts twice for the password on a terminal, else reads
+// the first line of stdin, so it stays out of the process list and the
+// shell history
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "confirm password: ")
+	check, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(check) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
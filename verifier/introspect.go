@@ -0,0 +1,63 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// introspector asks the auth service about tokens, RFC 7662 style
+type introspector struct {
+	url           string
+	authorization string
+	client        *http.Client
+}
+
+func (i *introspector) claims(ctx context.Context, token string) (*Claims, error) {
+	form := url.Values{"token": {token}}
+
+	req, err := http.NewRequest("POST", i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create introspection request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.authorization != "" {
+		req.Header.Set("Authorization", i.authorization)
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not introspect token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not introspect token: status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Active bool `json:"active"`
+		Claims
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, errors.Wrap(err, "could not decode introspection response")
+	}
+
+	if !body.Active {
+		return nil, errors.Wrap(ErrInvalidToken, "inactive token")
+	}
+
+	// the service already checked it, but a clock skew
+	// between us must not let expired tokens through
+	if err := body.Claims.Valid(); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+	return &body.Claims, nil
+}
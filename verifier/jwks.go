@@ -0,0 +1,195 @@
+package verifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// minRefresh limits how often unknown key IDs can trigger a JWKS fetch,
+// and how soon a failed fetch is tried again
+const minRefresh = 30 * time.Second
+
+// jwks caches the public keys published at url
+type jwks struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	failedAt  time.Time
+	err       error
+
+	// fetching is closed once the fetch in flight is done
+	fetching chan struct{}
+}
+
+// jwk is a single JSON Web Key, only RSA and EC keys are supported
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key is the jwt.Keyfunc returning the public key matching the token 'kid'
+func (s *jwks) key(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	s.mu.Lock()
+	_, known := s.keys[kid]
+	wait := s.fetching
+	if wait == nil && s.due(known) {
+		s.fetching = make(chan struct{})
+		s.mu.Unlock()
+		s.refresh()
+	} else {
+		s.mu.Unlock()
+		// the fetch in flight may bring the key
+		if wait != nil && !known {
+			<-wait
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[kid]
+	if !ok {
+		if s.keys == nil && s.err != nil {
+			return nil, s.err
+		}
+		return nil, fmt.Errorf("unknown key id '%s'", kid)
+	}
+	return k, nil
+}
+
+// due tells if the keys must be fetched again, never
+// sooner than minRefresh after a failure. Must hold mu
+func (s *jwks) due(known bool) bool {
+	if time.Since(s.failedAt) < minRefresh {
+		return false
+	}
+
+	since := time.Since(s.fetchedAt)
+	return s.keys == nil || since > s.ttl || (!known && since > minRefresh)
+}
+
+// refresh fetches the keys without holding mu, so tokens signed
+// with known keys are verified meanwhile, then wakes the waiters
+func (s *jwks) refresh() {
+	keys, err := s.fetch()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// stale keys are better than no keys
+	if err != nil {
+		s.failedAt, s.err = time.Now(), err
+	} else {
+		s.keys, s.fetchedAt, s.err = keys, time.Now(), nil
+	}
+
+	close(s.fetching)
+	s.fetching = nil
+}
+
+// fetch returns the keys at url. Keys that can't be
+// parsed are skipped, so they don't take the rest down
+func (s *jwks) fetch() (map[string]interface{}, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch jwks")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch jwks: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "could not decode jwks")
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+// publicKey builds the rsa or ecdsa public key described by k
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid modulus")
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid x coordinate")
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid y coordinate")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,109 @@
+package verifier
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+type contextKey struct{}
+
+// FromContext returns the claims put in the request context by the middleware
+func FromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(contextKey{}).(*Claims)
+	return c, ok
+}
+
+// NewContext returns a copy of ctx carrying c, mostly useful in tests
+func NewContext(ctx context.Context, c *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// Middleware only lets requests with a valid bearer token reach next,
+// answering 401 to the others the way the auth service does
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := v.authorize(w, r); ok {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Handle is the httprouter adapter of Middleware
+func (v *Verifier) Handle(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if r, ok := v.authorize(w, r); ok {
+			next(w, r, ps)
+		}
+	}
+}
+
+// RequirePermission wraps next so it only runs when the claims in the
+// context, put there by Middleware or Handle, grant permission perm
+func RequirePermission(perm string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := FromContext(r.Context())
+		if !ok || !c.HasPermission(perm) {
+			writeError(w, http.StatusForbidden, "Forbidden", "missing permission "+perm)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize verifies the request bearer token, writing the
+// error response and returning false if it is not valid
+func (v *Verifier) authorize(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	c, err := v.Verify(r.Context(), BearerToken(r))
+	if err == nil && !c.BoundTo(peerCert(r)) {
+		err = ErrCertMismatch
+	}
+	if err == nil {
+		return r.WithContext(NewContext(r.Context(), c)), true
+	}
+
+	switch errors.Cause(err) {
+	case ErrMissingToken:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "Unauthorized", ErrMissingToken.Error())
+	case ErrInvalidToken, ErrRevoked, ErrCertMismatch:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "Unauthorized", errors.Cause(err).Error())
+	default:
+		writeError(w, http.StatusServiceUnavailable, "Service Unavailable", "could not verify token")
+	}
+	return nil, false
+}
+
+// peerCert returns the verified client certificate of the request, if any
+func peerCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// BearerToken extracts the token from the Authorization header
+func BearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// writeError writes the same json errors the auth service API does
+func writeError(w http.ResponseWriter, code int, description, cause string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+		Cause       string `json:"cause,omitempty"`
+	}{code, description, cause})
+}
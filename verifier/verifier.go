@@ -0,0 +1,229 @@
+// Package verifier validates tokens issued by the auth service so
+// downstream services don't have to parse them on their own.
+//
+// A Verifier checks the token signature against a static key, a JWKS
+// URL or the auth service introspection endpoint, then the issuer,
+// audience, expiration and, optionally, revocation. Its middleware
+// puts the verified Claims into the request context:
+//
+//	v := verifier.NewStatic([]byte(secret), verifier.Options{Issuer: "https://api.alesr.me"})
+//	http.Handle("/", v.Middleware(handler))
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		c, _ := verifier.FromContext(r.Context())
+//		...
+//	}
+package verifier
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrMissingToken is returned when the request carries no bearer token
+	ErrMissingToken = errors.New("missing bearer token")
+
+	// ErrInvalidToken is returned for tokens with a bad signature,
+	// issuer, audience or expiration
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrRevoked is returned for otherwise valid tokens that were revoked
+	ErrRevoked = errors.New("revoked token")
+
+	// ErrCertMismatch is returned for tokens bound to a client
+	// certificate presented without that certificate
+	ErrCertMismatch = errors.New("certificate mismatch")
+)
+
+// Claims are the claims the auth service puts in its tokens,
+// the user ID is the standard 'sub' claim
+type Claims struct {
+	User         string        `json:"user"`
+	Email        string        `json:"email"`
+	Roles        []string      `json:"roles,omitempty"`
+	Permissions  []string      `json:"permissions,omitempty"`
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	jwt.StandardClaims
+}
+
+// Confirmation holds the thumbprint of the client certificate
+// a token is bound to, RFC 8705
+type Confirmation struct {
+	X5tS256 string `json:"x5t#S256"`
+}
+
+// BoundTo - check the claims can be used over a connection with the
+// client certificate cert, nil meaning none. Unbound claims always can
+func (c Claims) BoundTo(cert *x509.Certificate) bool {
+	if c.Confirmation == nil {
+		return true
+	}
+	if cert == nil {
+		return false
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	thumbprint := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(c.Confirmation.X5tS256), []byte(thumbprint)) == 1
+}
+
+// HasPermission - check if the claims grant permission perm
+func (c Claims) HasPermission(perm string) bool {
+	for _, p := range c.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole - check if the claims include role
+func (c Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Options are the checks every verifier runs on top of the signature
+type Options struct {
+	// Issuer must match the 'iss' claim, unless empty
+	Issuer string
+
+	// Audience must be the 'aud' claim, unless empty
+	Audience string
+
+	// Revoked is asked about every token that passed all other checks,
+	// returning true rejects it. Leave it nil to skip revocation checks.
+	// Introspection verifiers don't need it, the auth service checks it
+	Revoked func(ctx context.Context, c *Claims) (bool, error)
+
+	// Client is used for JWKS and introspection requests,
+	// defaults to a client with a 10 seconds timeout
+	Client *http.Client
+}
+
+// Verifier validates tokens and the requests carrying them
+type Verifier struct {
+	opts Options
+
+	// exactly one of them is set, depending on the constructor
+	keys       *keySource
+	introspect *introspector
+}
+
+// NewStatic - verify tokens signed with HMAC using secret,
+// the same token_signature configured in the auth service
+func NewStatic(secret []byte, opts Options) *Verifier {
+	return &Verifier{
+		opts: withDefaults(opts),
+		keys: &keySource{
+			methods: []string{"HS256", "HS384", "HS512"},
+			key: func(*jwt.Token) (interface{}, error) {
+				return secret, nil
+			},
+		},
+	}
+}
+
+// NewJWKS - verify tokens signed with RSA or ECDSA using the public
+// keys published at jwksURL, matched on the token 'kid' header. Keys
+// are cached for ttl and refreshed early when an unknown 'kid' shows up
+func NewJWKS(jwksURL string, ttl time.Duration, opts Options) *Verifier {
+	opts = withDefaults(opts)
+	set := &jwks{url: jwksURL, ttl: ttl, client: opts.Client}
+
+	return &Verifier{
+		opts: opts,
+		keys: &keySource{
+			methods: []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"},
+			key:     set.key,
+		},
+	}
+}
+
+// NewIntrospection - ask the auth service introspection endpoint at
+// introspectionURL whether tokens are active. This also covers
+// revocation and personal access tokens, which can't be verified
+// locally, at the cost of a request per verification.
+// authorization, when not empty, is sent as the Authorization header
+func NewIntrospection(introspectionURL, authorization string, opts Options) *Verifier {
+	opts = withDefaults(opts)
+	return &Verifier{
+		opts:       opts,
+		introspect: &introspector{url: introspectionURL, authorization: authorization, client: opts.Client},
+	}
+}
+
+// Verify - validate token and return its claims. The errors.Cause
+// of failed verifications is ErrMissingToken, ErrInvalidToken or
+// ErrRevoked, anything else means the verification itself failed
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+
+	var c *Claims
+	var err error
+	if v.introspect != nil {
+		c, err = v.introspect.claims(ctx, token)
+	} else {
+		c, err = v.keys.claims(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if v.opts.Issuer != "" && !c.VerifyIssuer(v.opts.Issuer, true) {
+		return nil, errors.Wrap(ErrInvalidToken, fmt.Sprintf("unexpected issuer '%s'", c.Issuer))
+	}
+
+	if v.opts.Audience != "" && !c.VerifyAudience(v.opts.Audience, true) {
+		return nil, errors.Wrap(ErrInvalidToken, fmt.Sprintf("unexpected audience '%s'", c.Audience))
+	}
+
+	if v.opts.Revoked != nil {
+		revoked, err := v.opts.Revoked(ctx, c)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not check revocation")
+		}
+		if revoked {
+			return nil, ErrRevoked
+		}
+	}
+	return c, nil
+}
+
+// keySource verifies tokens locally with the key returned by key
+type keySource struct {
+	methods []string
+	key     jwt.Keyfunc
+}
+
+func (s *keySource) claims(token string) (*Claims, error) {
+	c := &Claims{}
+	p := jwt.Parser{ValidMethods: s.methods}
+	if _, err := p.ParseWithClaims(token, c, s.key); err != nil {
+		return nil, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+	return c, nil
+}
+
+func withDefaults(opts Options) Options {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return opts
+}
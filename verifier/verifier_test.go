@@ -0,0 +1,298 @@
+package verifier
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+func newClaims() Claims {
+	return Claims{
+		User:        "gopher",
+		Email:       "gopher@foomail.com",
+		Permissions: []string{"users:read"},
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "4f1c6b1e",
+			Issuer:    "tester",
+			Audience:  "xablau",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+}
+
+func sign(t *testing.T, c Claims, m jwt.SigningMethod, kid string, key interface{}) string {
+	token := jwt.NewWithClaims(m, c)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	ss, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("could not sign token: %s", err)
+	}
+	return ss
+}
+
+func TestStatic(t *testing.T) {
+	secret := []byte("foobar")
+
+	expired := newClaims()
+	expired.ExpiresAt = 1
+
+	wrongIssuer := newClaims()
+	wrongIssuer.Issuer = "xablau"
+
+	wrongAudience := newClaims()
+	wrongAudience.Audience = "tester"
+
+	revoked := newClaims()
+	revoked.Id = "revoked"
+
+	tt := []struct {
+		label string
+		token string
+		err   error
+	}{
+		{"valid", sign(t, newClaims(), jwt.SigningMethodHS256, "", secret), nil},
+		{"missing", "", ErrMissingToken},
+		{"garbage", "xablau", ErrInvalidToken},
+		{"wrong signature", sign(t, newClaims(), jwt.SigningMethodHS256, "", []byte("xablau")), ErrInvalidToken},
+		{"unsigned", sign(t, newClaims(), jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType), ErrInvalidToken},
+		{"expired", sign(t, expired, jwt.SigningMethodHS256, "", secret), ErrInvalidToken},
+		{"wrong issuer", sign(t, wrongIssuer, jwt.SigningMethodHS256, "", secret), ErrInvalidToken},
+		{"wrong audience", sign(t, wrongAudience, jwt.SigningMethodHS256, "", secret), ErrInvalidToken},
+		{"revoked", sign(t, revoked, jwt.SigningMethodHS256, "", secret), ErrRevoked},
+	}
+
+	v := NewStatic(secret, Options{
+		Issuer:   "tester",
+		Audience: "xablau",
+		Revoked: func(_ context.Context, c *Claims) (bool, error) {
+			return c.Id == "revoked", nil
+		},
+	})
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			c, err := v.Verify(context.Background(), tc.token)
+			if errors.Cause(err) != tc.err {
+				t.Fatalf("expected error '%v'; got '%v'", tc.err, err)
+			}
+
+			if err == nil && c.Subject != "4f1c6b1e" {
+				t.Errorf("expected sub '4f1c6b1e'; got '%s'", c.Subject)
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate rsa key: %s", err)
+	}
+
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string][]jwk{
+			"keys": {{
+				Kid: "k1",
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}, {
+				// unsupported keys don't take the others down
+				Kid: "k3",
+				Kty: "EC",
+				Crv: "P-192",
+			}},
+		})
+	}))
+	defer srv.Close()
+
+	v := NewJWKS(srv.URL, time.Hour, Options{Issuer: "tester"})
+
+	tt := []struct {
+		label string
+		token string
+		err   error
+	}{
+		{"valid", sign(t, newClaims(), jwt.SigningMethodRS256, "k1", key), nil},
+		{"cached", sign(t, newClaims(), jwt.SigningMethodRS256, "k1", key), nil},
+		{"unknown kid", sign(t, newClaims(), jwt.SigningMethodRS256, "k2", key), ErrInvalidToken},
+		{"hmac with public key", sign(t, newClaims(), jwt.SigningMethodHS256, "k1", []byte("xablau")), ErrInvalidToken},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			if _, err := v.Verify(context.Background(), tc.token); errors.Cause(err) != tc.err {
+				t.Errorf("expected error '%v'; got '%v'", tc.err, err)
+			}
+		})
+	}
+
+	if fetches != 1 {
+		t.Errorf("expected jwks to be fetched once; got %d", fetches)
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate rsa key: %s", err)
+	}
+
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	v := NewJWKS(srv.URL, time.Hour, Options{Issuer: "tester"})
+
+	// failed fetches back off instead of hitting the issuer for every token
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(context.Background(), sign(t, newClaims(), jwt.SigningMethodRS256, "k1", key)); errors.Cause(err) != ErrInvalidToken {
+			t.Errorf("expected error '%v'; got '%v'", ErrInvalidToken, err)
+		}
+	}
+
+	if fetches != 1 {
+		t.Errorf("expected jwks to be fetched once; got %d", fetches)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic Zm9vOmJhcg==" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.FormValue("token") != "active" {
+			w.Write([]byte(`{"active":false}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			Active bool `json:"active"`
+			Claims
+		}{true, newClaims()})
+	}))
+	defer srv.Close()
+
+	tt := []struct {
+		label string
+		auth  string
+		token string
+		err   error
+	}{
+		{"active", "Basic Zm9vOmJhcg==", "active", nil},
+		{"inactive", "Basic Zm9vOmJhcg==", "xablau", ErrInvalidToken},
+		{"unauthorized", "", "active", nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			v := NewIntrospection(srv.URL, tc.auth, Options{Issuer: "tester"})
+
+			c, err := v.Verify(context.Background(), tc.token)
+			if tc.auth == "" {
+				// the verification itself failed
+				if err == nil || errors.Cause(err) == ErrInvalidToken {
+					t.Errorf("expected introspection error; got '%v'", err)
+				}
+				return
+			}
+
+			if errors.Cause(err) != tc.err {
+				t.Fatalf("expected error '%v'; got '%v'", tc.err, err)
+			}
+
+			if err == nil && c.Email != "gopher@foomail.com" {
+				t.Errorf("expected email 'gopher@foomail.com'; got '%s'", c.Email)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	secret := []byte("foobar")
+	v := NewStatic(secret, Options{Issuer: "tester"})
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := FromContext(r.Context())
+		w.Write([]byte(c.Subject))
+	})
+
+	router := httprouter.New()
+	router.GET("/router", v.Handle(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ok(w, r)
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/plain", v.Middleware(ok))
+	mux.Handle("/perm", v.Middleware(RequirePermission("users:write", ok)))
+	mux.Handle("/router", router)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	token := sign(t, newClaims(), jwt.SigningMethodHS256, "", secret)
+
+	// the test server has no tls, so no client certificate
+	bound := newClaims()
+	bound.Confirmation = &Confirmation{X5tS256: "c2VydmljZQ"}
+	boundToken := sign(t, bound, jwt.SigningMethodHS256, "", secret)
+
+	tt := []struct {
+		label      string
+		path       string
+		auth       string
+		statusCode int
+	}{
+		{"valid", "/plain", "Bearer " + token, 200},
+		{"bound without certificate", "/plain", "Bearer " + boundToken, 401},
+		{"missing", "/plain", "", 401},
+		{"invalid", "/plain", "Bearer xablau", 401},
+		{"missing permission", "/perm", "Bearer " + token, 403},
+		{"router valid", "/router", "Bearer " + token, 200},
+		{"router invalid", "/router", "Bearer xablau", 401},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.label, func(t *testing.T) {
+			req, err := http.NewRequest("GET", srv.URL+tc.path, nil)
+			if err != nil {
+				t.Fatalf("could not create request: %s", err)
+			}
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not execute request: %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d; got %d", tc.statusCode, resp.StatusCode)
+			}
+		})
+	}
+}